@@ -13,6 +13,13 @@ type arithmeticAcConditioning struct {
 	kx uint8
 }
 
+// The default arithmetic conditioning, which is used unless a DAC marker
+// says otherwise, as specified in section F.1.4.4.
+var (
+	defaultDcConditioning = arithmeticDcConditioning{lower: 0, upper: 1 << 1}
+	defaultAcConditioning = arithmeticAcConditioning{kx: 5}
+)
+
 // arithmetic is a Arithmetic decoder, specified in section D.
 type arithmetic struct {
 	// States for DC coefficients.
@@ -219,27 +226,33 @@ func (d *decoder) initDecodeArithmetic() error {
 	return nil
 }
 
-// decodeArithmeticDC returns the next Arithmetic-coded DC delta value from the bit-stream,
-// decoded according to a.
-func (d *decoder) decodeArithmeticDC(a *arithmetic, conditioning *arithmeticDcConditioning, prevDcDelta int32) (int32, error) {
-	var c = 0
+// dcContext returns the index of the states with which a DC delta value is
+// coded, which depends on the previous DC delta value of the component, as
+// specified in section F.1.4.4.1.2.
+func dcContext(conditioning *arithmeticDcConditioning, prevDcDelta int32) int {
 	if prevDcDelta >= 0 {
 		if prevDcDelta <= conditioning.lower {
-			c = 0
+			return 0
 		} else if prevDcDelta <= conditioning.upper {
-			c = 1
+			return 1
 		} else {
-			c = 2
+			return 2
 		}
 	} else {
 		if prevDcDelta >= -conditioning.lower {
-			c = 0
+			return 0
 		} else if prevDcDelta >= -conditioning.upper {
-			c = 3
+			return 3
 		} else {
-			c = 4
+			return 4
 		}
 	}
+}
+
+// decodeArithmeticDC returns the next Arithmetic-coded DC delta value from the bit-stream,
+// decoded according to a.
+func (d *decoder) decodeArithmeticDC(a *arithmetic, conditioning *arithmeticDcConditioning, prevDcDelta int32) (int32, error) {
+	c := dcContext(conditioning, prevDcDelta)
 
 	bit, err := d.decodeArithmeticBit(a, &a.dcNonZero[c])
 	if err != nil {
@@ -302,8 +315,9 @@ func (d *decoder) decodeArithmeticDC(a *arithmetic, conditioning *arithmeticDcCo
 }
 
 // decodeArithmeticAC returns the next Arithmetic-coded AC value from the bit-stream,
-// decoded according to a.
-func (d *decoder) decodeArithmeticAC(a *arithmetic, conditioning *arithmeticAcConditioning, k uint8) (uint8, int32, bool, error) {
+// decoded according to a. The run of zero coefficients before it may not go past
+// the coefficient end.
+func (d *decoder) decodeArithmeticAC(a *arithmetic, conditioning *arithmeticAcConditioning, k uint8, end uint8) (uint8, int32, bool, error) {
 	bit, err := d.decodeArithmeticBit(a, &a.acEndOfBlock[k-1])
 	if err != nil {
 		return 0, 0, false, err
@@ -323,6 +337,9 @@ func (d *decoder) decodeArithmeticAC(a *arithmetic, conditioning *arithmeticAcCo
 		}
 		r++
 		k++
+		if k > end {
+			return 0, 0, false, FormatError("too many coefficients")
+		}
 	}
 
 	bit, err = d.decodeArithmeticFixedBit(a)
@@ -391,6 +408,83 @@ func (d *decoder) decodeArithmeticAC(a *arithmetic, conditioning *arithmeticAcCo
 	return r, sign * magnitude, false, nil
 }
 
+// refineArithmetic decodes an Arithmetic-coded successive approximation
+// refinement block, as specified in section G.1.3.
+func (d *decoder) refineArithmetic(b *block, a *arithmetic, zigStart uint8, zigEnd uint8, delta int32) error {
+	// Refining a DC component is trivial.
+	if zigStart == 0 {
+		bit, err := d.decodeArithmeticFixedBit(a)
+		if err != nil {
+			return err
+		}
+		if bit == 1 {
+			b[0] |= delta
+		}
+		return nil
+	}
+
+	// The end of block is only coded after the last coefficient that was
+	// non-zero before this scan.
+	prevEOB := uint8(0)
+	for zig := zigEnd; zig > 0; zig-- {
+		if b[unzig[zig]] != 0 {
+			prevEOB = zig
+			break
+		}
+	}
+	for zig := zigStart; zig <= zigEnd; zig++ {
+		if zig > prevEOB {
+			bit, err := d.decodeArithmeticBit(a, &a.acEndOfBlock[zig-1])
+			if err != nil {
+				return err
+			}
+			if bit == 1 {
+				break
+			}
+		}
+		for {
+			u := unzig[zig]
+			if b[u] != 0 {
+				// Refine a previously non-zero coefficient.
+				bit, err := d.decodeArithmeticBit(a, &a.acUnitOrShort[zig-1])
+				if err != nil {
+					return err
+				}
+				if bit == 1 {
+					if b[u] >= 0 {
+						b[u] += delta
+					} else {
+						b[u] -= delta
+					}
+				}
+				break
+			}
+			bit, err := d.decodeArithmeticBit(a, &a.acNonZero[zig-1])
+			if err != nil {
+				return err
+			}
+			if bit == 1 {
+				// The coefficient is newly non-zero.
+				bit, err = d.decodeArithmeticFixedBit(a)
+				if err != nil {
+					return err
+				}
+				if bit == 1 {
+					b[u] = -delta
+				} else {
+					b[u] = delta
+				}
+				break
+			}
+			zig++
+			if zig > zigEnd {
+				return FormatError("too many coefficients")
+			}
+		}
+	}
+	return nil
+}
+
 func (d *decoder) decodeArithmeticBit(a *arithmetic, state *arithmeticState) (uint8, error) {
 	s := &arithmeticStateMachine[state.index]
 	d.arith.a -= s.qe
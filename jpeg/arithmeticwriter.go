@@ -0,0 +1,355 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+// arithmeticEncoder is the state of an arithmetic encoder, specified in
+// section D.1. It codes the same decisions, with the same probability
+// estimation states, as the decoder in arithmetic.go decodes, and outputs
+// bytes as libjpeg's jcarith.c does.
+type arithmeticEncoder struct {
+	// c and a are the code and interval registers, and ct is the number of
+	// shifts of c until the next byte is output.
+	c, a uint32
+	ct   int
+	// buffer is the last byte that was output to c, which a carry may yet
+	// increment, or -1 if there is none. sc is the number of 0xff bytes
+	// after it, which are held back for the same reason, and zc is the
+	// number of zero bytes before it, which are held back since any at the
+	// end of the data need not be written.
+	buffer int
+	sc, zc int
+	// states is the probability estimation states of each table.
+	states [maxTc + 1][maxTb + 1]arithmetic
+	// prevDcDelta is the previous DC delta of each component, which
+	// conditions the coding of the next one.
+	prevDcDelta [maxComponents]int32
+}
+
+// reset initializes the encoder for the start of a scan or restart interval,
+// as per section D.1.7.
+func (a *arithmeticEncoder) reset() {
+	*a = arithmeticEncoder{a: 0x10000, ct: 11, buffer: -1}
+}
+
+// emitArithmeticByte writes the byte b of arithmetic-coded data, stuffing a
+// zero byte after a 0xff one.
+func (e *encoder) emitArithmeticByte(b uint8) {
+	e.writeByte(b)
+	if b == 0xff {
+		e.writeByte(0x00)
+	}
+}
+
+// emitArithmeticZeroes writes the zero bytes that are held back.
+func (e *encoder) emitArithmeticZeroes() {
+	for ; e.arith.zc > 0; e.arith.zc-- {
+		e.writeByte(0x00)
+	}
+}
+
+// emitArithmeticCarry writes the held back bytes when a carry propagates
+// into them: the buffered byte is incremented, and the stacked 0xff bytes
+// become zero bytes, which are held back.
+func (e *encoder) emitArithmeticCarry() {
+	a := e.arith
+	if a.buffer >= 0 {
+		e.emitArithmeticZeroes()
+		e.emitArithmeticByte(uint8(a.buffer + 1))
+	}
+	a.zc += a.sc
+	a.sc = 0
+}
+
+// emitArithmeticBuffer writes the held back bytes when no carry can
+// propagate into them any more.
+func (e *encoder) emitArithmeticBuffer() {
+	a := e.arith
+	if a.buffer == 0 {
+		a.zc++
+	} else if a.buffer > 0 {
+		e.emitArithmeticZeroes()
+		e.emitArithmeticByte(uint8(a.buffer))
+	}
+	if a.sc > 0 {
+		e.emitArithmeticZeroes()
+		for ; a.sc > 0; a.sc-- {
+			e.emitArithmeticByte(0xff)
+		}
+	}
+}
+
+// encodeArithmeticBit encodes bit, whose probability is estimated by state,
+// as specified in section D.1.
+func (e *encoder) encodeArithmeticBit(state *arithmeticState, bit uint8) {
+	a := e.arith
+	s := &arithmeticStateMachine[state.index]
+	qe := uint32(s.qe)
+	a.a -= qe
+	if bit != state.mps {
+		// Code the less probable symbol, exchanging the sub-intervals if
+		// the more probable symbol's one is smaller.
+		if a.a >= qe {
+			a.c += a.a
+			a.a = qe
+		}
+		if s.switchMps {
+			state.mps ^= 1
+		}
+		state.index = s.nextLps
+	} else {
+		if a.a >= 0x8000 {
+			return
+		}
+		if a.a < qe {
+			a.c += a.a
+			a.a = qe
+		}
+		state.index = s.nextMps
+	}
+
+	// Renormalize, outputting a byte whenever one is complete, as per
+	// section D.1.6.
+	for a.a < 0x8000 {
+		a.a <<= 1
+		a.c <<= 1
+		a.ct--
+		if a.ct > 0 {
+			continue
+		}
+		switch b := a.c >> 19; {
+		case b > 0xff:
+			e.emitArithmeticCarry()
+			a.buffer = int(b & 0xff)
+		case b == 0xff:
+			a.sc++
+		default:
+			e.emitArithmeticBuffer()
+			a.buffer = int(b)
+		}
+		a.c &= 0x7ffff
+		a.ct += 8
+	}
+}
+
+// encodeArithmeticFixedBit encodes bit with a fixed probability of one half,
+// as is used for signs and refinement bits.
+func (e *encoder) encodeArithmeticFixedBit(bit uint8) {
+	var fixedState arithmeticState
+	e.encodeArithmeticBit(&fixedState, bit)
+}
+
+// finishArithmetic ends the arithmetic-coded data of a scan or restart
+// interval, as specified in section D.1.8, and resets the encoder for the
+// next one.
+func (e *encoder) finishArithmetic() {
+	a := e.arith
+	// Choose the value in the final interval with the most trailing zero
+	// bits.
+	if c := (a.a - 1 + a.c) &^ 0xffff; c < a.c {
+		a.c = c + 0x8000
+	} else {
+		a.c = c
+	}
+	a.c <<= a.ct
+	if a.c&0xf8000000 != 0 {
+		e.emitArithmeticCarry()
+	} else {
+		e.emitArithmeticBuffer()
+	}
+	// The final bytes are only written if they are not zero.
+	if a.c&0x7fff800 != 0 {
+		e.emitArithmeticZeroes()
+		e.emitArithmeticByte(uint8(a.c >> 19))
+		if a.c&0x7f800 != 0 {
+			e.emitArithmeticByte(uint8(a.c >> 11))
+		}
+	}
+	a.reset()
+}
+
+// encodeArithmeticBlock encodes the scan s of the block z, which is in
+// zig-zag order, of the i'th component. The first component uses the
+// luminance tables, and the others use the chrominance ones.
+func (e *encoder) encodeArithmeticBlock(z *block, i int, s *Scan) {
+	a := e.arith
+	t := min(i, 1)
+	k := s.SpectralStart
+	if k == 0 {
+		if s.ApproxHigh == 0 {
+			dc := z[0] >> s.ApproxLow
+			delta := dc - e.prevDC[i]
+			e.encodeArithmeticDC(&a.states[dcTable][t], &defaultDcConditioning, a.prevDcDelta[i], delta)
+			e.prevDC[i], a.prevDcDelta[i] = dc, delta
+		} else {
+			// The refinement of a DC coefficient is its next bit, as per
+			// section G.1.3.1.
+			e.encodeArithmeticFixedBit(uint8(z[0]>>s.ApproxLow) & 1)
+		}
+		k++
+	}
+	if k > s.SpectralEnd {
+		return
+	}
+	if s.ApproxHigh == 0 {
+		e.encodeArithmeticAC(z, &a.states[acTable][t], &defaultAcConditioning, k, s.SpectralEnd, s.ApproxLow)
+	} else {
+		e.encodeArithmeticACRefine(z, &a.states[acTable][t], k, s.SpectralEnd, s.ApproxLow)
+	}
+}
+
+// encodeArithmeticDC encodes a DC delta value, as specified in section
+// F.1.4.1. It is the inverse of decodeArithmeticDC.
+func (e *encoder) encodeArithmeticDC(a *arithmetic, conditioning *arithmeticDcConditioning, prevDcDelta, delta int32) {
+	c := dcContext(conditioning, prevDcDelta)
+	if delta == 0 {
+		e.encodeArithmeticBit(&a.dcNonZero[c], 0)
+		return
+	}
+	e.encodeArithmeticBit(&a.dcNonZero[c], 1)
+	magState := &a.dcPositiveUnit[c]
+	if delta < 0 {
+		e.encodeArithmeticBit(&a.dcSign[c], 1)
+		magState = &a.dcNegativeUnit[c]
+		delta = -delta
+	} else {
+		e.encodeArithmeticBit(&a.dcSign[c], 0)
+	}
+	// The magnitude is coded as m, which is one less than it: whether m is
+	// zero, the number of bits of m after its leading one, and those bits.
+	m := uint32(delta - 1)
+	if m == 0 {
+		e.encodeArithmeticBit(magState, 0)
+		return
+	}
+	e.encodeArithmeticBit(magState, 1)
+	width := 0
+	for m>>(width+1) != 0 {
+		e.encodeArithmeticBit(&a.dcWidth[width], 1)
+		width++
+	}
+	e.encodeArithmeticBit(&a.dcWidth[width], 0)
+	if width > 0 {
+		e.encodeArithmeticBits(m, width, &a.dcMagnitude[width-1])
+	}
+}
+
+// encodeArithmeticBits encodes the low width bits of m, most significant
+// first, with state.
+func (e *encoder) encodeArithmeticBits(m uint32, width int, state *arithmeticState) {
+	for j := width - 1; j >= 0; j-- {
+		e.encodeArithmeticBit(state, uint8(m>>j)&1)
+	}
+}
+
+// encodeArithmeticAC encodes the AC coefficients from zigStart to zigEnd of
+// the block z, which is in zig-zag order, with the point transform al, as
+// specified in sections F.1.4.2 and G.1.3.2. It is the inverse of
+// decodeArithmeticAC.
+func (e *encoder) encodeArithmeticAC(z *block, a *arithmetic, conditioning *arithmeticAcConditioning, zigStart, zigEnd, al int) {
+	// ac is the coefficients after the point transform, which divides by
+	// 2**al, rounding towards zero, and eob is the index of the last
+	// non-zero one.
+	var ac [blockSize]int32
+	eob := zigStart - 1
+	for k := zigStart; k <= zigEnd; k++ {
+		ac[k] = max(z[k], -z[k]) >> al
+		if z[k] < 0 {
+			ac[k] = -ac[k]
+		}
+		if ac[k] != 0 {
+			eob = k
+		}
+	}
+	k := zigStart
+	for ; k <= eob; k++ {
+		e.encodeArithmeticBit(&a.acEndOfBlock[k-1], 0)
+		for ac[k] == 0 {
+			e.encodeArithmeticBit(&a.acNonZero[k-1], 0)
+			k++
+		}
+		e.encodeArithmeticBit(&a.acNonZero[k-1], 1)
+		v := ac[k]
+		if v < 0 {
+			e.encodeArithmeticFixedBit(1)
+			v = -v
+		} else {
+			e.encodeArithmeticFixedBit(0)
+		}
+		// The magnitude is coded as for a DC delta, except that the state
+		// for whether m is zero also codes whether it is one.
+		m := uint32(v - 1)
+		if m == 0 {
+			e.encodeArithmeticBit(&a.acUnitOrShort[k-1], 0)
+			continue
+		}
+		e.encodeArithmeticBit(&a.acUnitOrShort[k-1], 1)
+		if m == 1 {
+			e.encodeArithmeticBit(&a.acUnitOrShort[k-1], 0)
+			continue
+		}
+		e.encodeArithmeticBit(&a.acUnitOrShort[k-1], 1)
+		widthStates, magnitudeStates := &a.acLowWidth, &a.acLowMagnitude
+		if k > int(conditioning.kx) {
+			widthStates, magnitudeStates = &a.acHighWidth, &a.acHighMagnitude
+		}
+		width := 1
+		for m>>(width+1) != 0 {
+			e.encodeArithmeticBit(&widthStates[width-1], 1)
+			width++
+		}
+		e.encodeArithmeticBit(&widthStates[width-1], 0)
+		e.encodeArithmeticBits(m, width, &magnitudeStates[width-1])
+	}
+	if k <= zigEnd {
+		e.encodeArithmeticBit(&a.acEndOfBlock[k-1], 1)
+	}
+}
+
+// encodeArithmeticACRefine encodes a refinement scan of the AC coefficients
+// from zigStart to zigEnd of the block z, which is in zig-zag order, with
+// the point transform al, as specified in section G.1.3.3. It is the
+// inverse of refineArithmetic.
+func (e *encoder) encodeArithmeticACRefine(z *block, a *arithmetic, zigStart, zigEnd, al int) {
+	// abs is the absolute values of the coefficients after the point
+	// transform. eob is the index of the last non-zero one, and prevEOB is
+	// that of the last one that was non-zero after the previous scan.
+	var abs [blockSize]int32
+	eob, prevEOB := zigStart-1, zigStart-1
+	for k := zigStart; k <= zigEnd; k++ {
+		abs[k] = max(z[k], -z[k]) >> al
+		if abs[k] != 0 {
+			eob = k
+		}
+		if abs[k] > 1 {
+			prevEOB = k
+		}
+	}
+	k := zigStart
+	for ; k <= eob; k++ {
+		if k > prevEOB {
+			e.encodeArithmeticBit(&a.acEndOfBlock[k-1], 0)
+		}
+		for abs[k] == 0 {
+			e.encodeArithmeticBit(&a.acNonZero[k-1], 0)
+			k++
+		}
+		if abs[k] > 1 {
+			// The coefficient was already non-zero, so it has a correction
+			// bit.
+			e.encodeArithmeticBit(&a.acUnitOrShort[k-1], uint8(abs[k]&1))
+			continue
+		}
+		// The coefficient is newly non-zero.
+		e.encodeArithmeticBit(&a.acNonZero[k-1], 1)
+		if z[k] < 0 {
+			e.encodeArithmeticFixedBit(1)
+		} else {
+			e.encodeArithmeticFixedBit(0)
+		}
+	}
+	if k <= zigEnd {
+		e.encodeArithmeticBit(&a.acEndOfBlock[k-1], 1)
+	}
+}
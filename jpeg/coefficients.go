@@ -0,0 +1,387 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+)
+
+// A Block is the 64 quantized DCT coefficients of an 8x8 block of samples.
+// They are in natural order, row by row, unless stated otherwise.
+type Block [blockSize]int32
+
+// Coefficients is a JPEG image's quantized DCT coefficients, as returned by
+// [DecodeCoefficients].
+type Coefficients struct {
+	// Width and Height are the image dimensions, in pixels.
+	Width, Height int
+	// ColorModel is the color model of the decoded image, as reported by
+	// [DecodeConfig].
+	ColorModel color.Model
+	// AdobeTransform is the color transform from an Adobe APP14 segment: 0
+	// for none (RGB or CMYK), 1 for YCbCr and 2 for YCCK. It is -1 if there
+	// is no such segment.
+	AdobeTransform int
+
+	// Progressive is whether the image is progressive, and Arithmetic is
+	// whether it is arithmetic coded rather than Huffman coded.
+	Progressive, Arithmetic bool
+	// RestartInterval is the number of MCUs between restart markers, or zero
+	// if there are none.
+	RestartInterval int
+	// Scans is the layout of the image's scans, in order.
+	Scans []Scan
+
+	// Metadata is the image's APPn and COM segments, in order, other than
+	// an Adobe APP14 segment, if the Metadata option was set.
+	Metadata []Segment
+
+	// ZigZag is whether the blocks and quantization tables are in zig-zag
+	// order, as in the JPEG data, instead of natural order.
+	ZigZag bool
+	// Components is the image's components, such as Y, Cb and Cr.
+	Components []ComponentCoefficients
+}
+
+// A Segment is a marker segment of a JPEG file, such as an APPn segment
+// holding Exif metadata.
+type Segment struct {
+	// Marker is the marker code, such as 0xe1 for APP1.
+	Marker uint8
+	// Data is the contents of the segment, after its length.
+	Data []byte
+	// pos is, for a segment passed to the edit function of EditMetadata, one
+	// more than the number of other segments before it in the input, so that
+	// it can be written back in the same place. It is zero otherwise.
+	pos int
+}
+
+// ComponentCoefficients is the quantized DCT coefficients of one component
+// of a JPEG image.
+type ComponentCoefficients struct {
+	// ID is the component identifier from the SOF segment.
+	ID uint8
+	// H and V are the horizontal and vertical sampling factors.
+	H, V int
+	// Quant is the quantization table. Multiplying a block's coefficients by
+	// it gives the DCT coefficients.
+	Quant Block
+	// BlocksWide and BlocksHigh are the number of blocks across and down.
+	// They cover the MCUs (Minimum Coded Units) that cover the image, so the
+	// blocks at the right and bottom edges may be beyond the image.
+	BlocksWide, BlocksHigh int
+	// Blocks is the BlocksWide*BlocksHigh blocks, row by row.
+	Blocks []Block
+}
+
+// Scan describes one scan of a JPEG image. Sequential images usually have a
+// single scan of all of the components, with the sequential parameters 0,
+// 63, 0 and 0.
+type Scan struct {
+	// Components is the indexes, in the Coefficients' Components, of the
+	// components in the scan.
+	Components []int
+	// SpectralStart and SpectralEnd are the first and last coefficients, in
+	// zig-zag order, in the scan. ApproxHigh and ApproxLow are the
+	// successive approximation bit positions. The specification calls them
+	// Ss, Se, Ah and Al.
+	SpectralStart, SpectralEnd int
+	ApproxHigh, ApproxLow      int
+}
+
+// CoefficientOptions are the parameters for DecodeCoefficients.
+type CoefficientOptions struct {
+	// ZigZag means that the blocks and quantization tables are returned in
+	// zig-zag order instead of natural order.
+	ZigZag bool
+	// Metadata means that the APPn and COM segments are returned in the
+	// Coefficients' Metadata.
+	Metadata bool
+	// Tables is as for DecoderOptions.
+	Tables *Tables
+}
+
+// DecodeCoefficients reads a JPEG image from r and returns its quantized
+// DCT coefficients, without reconstructing the image. Default parameters are
+// used if a nil *CoefficientOptions is passed. Errors are as for
+// [DecodeContext].
+func DecodeCoefficients(ctx context.Context, r io.Reader, o *CoefficientOptions) (*Coefficients, error) {
+	d := decoder{ctx: ctx, coeffsOnly: true, keepMetadata: o != nil && o.Metadata}
+	if o != nil {
+		d.opts.Tables = o.Tables
+	}
+	if _, err := d.decode(r, false); err != nil {
+		return nil, d.wrapError(err)
+	}
+	if d.nScan == 0 {
+		return nil, d.wrapError(FormatError("missing SOS marker"))
+	}
+	c := &Coefficients{
+		Width:           d.width,
+		Height:          d.height,
+		ColorModel:      d.colorModel(),
+		AdobeTransform:  -1,
+		Progressive:     d.progressive,
+		Arithmetic:      d.arithmetic,
+		RestartInterval: d.ri,
+		Scans:           d.scans,
+		Metadata:        d.metadata,
+		ZigZag:          o != nil && o.ZigZag,
+		Components:      make([]ComponentCoefficients, d.nComp),
+	}
+	if d.adobeTransformValid {
+		c.AdobeTransform = int(d.adobeTransform)
+	}
+	// The mxx and myy variables have the same meaning as in the processSOS
+	// method.
+	h0, v0 := d.comp[0].h, d.comp[0].v
+	mxx := (d.width + 8*h0 - 1) / (8 * h0)
+	myy := (d.height + 8*v0 - 1) / (8 * v0)
+	for i := range c.Components {
+		comp := &d.comp[i]
+		cc := &c.Components[i]
+		cc.ID, cc.H, cc.V = comp.c, comp.h, comp.v
+		cc.BlocksWide, cc.BlocksHigh = mxx*comp.h, myy*comp.v
+		cc.Quant = Block(d.quant[comp.tq])
+		if !c.ZigZag {
+			cc.Quant = unzigBlock(cc.Quant)
+		}
+		cc.Blocks = make([]Block, cc.BlocksWide*cc.BlocksHigh)
+		for j, b := range d.progCoeffs[i] {
+			if c.ZigZag {
+				cc.Blocks[j] = zigBlock(Block(b))
+			} else {
+				cc.Blocks[j] = Block(b)
+			}
+		}
+	}
+	return c, nil
+}
+
+// zigBlock returns b, which is in natural order, in zig-zag order.
+func zigBlock(b Block) (z Block) {
+	for zig, i := range unzig {
+		z[zig] = b[i]
+	}
+	return z
+}
+
+// unzigBlock returns z, which is in zig-zag order, in natural order.
+func unzigBlock(z Block) (b Block) {
+	for zig, i := range unzig {
+		b[i] = z[zig]
+	}
+	return b
+}
+
+// EncodeCoefficients writes the JPEG image whose quantized DCT coefficients
+// are c to w. No forward DCT or quantization is performed, so the
+// coefficients are kept exactly, as are the component identifiers, sampling
+// factors, quantization tables, restart interval, metadata and Adobe color
+// transform.
+// The image is arithmetic coded if Arithmetic is set, with the default
+// conditioning, and otherwise Huffman coded, with Huffman tables that are
+// optimized for it. A sequential image is written as a single scan
+// of all of the components. A progressive image is written with the given
+// Scans, or libjpeg's default progression if there are none. With either
+// coder, the AC coefficients must fit in 10 bits, and the differences
+// between the DC coefficients of consecutive blocks in 11 bits, as they do
+// for the DCT of 8-bit samples.
+func EncodeCoefficients(w io.Writer, c *Coefficients) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	scans := c.Scans
+	if !c.Progressive {
+		// A sequential image has a single scan of all of the components.
+		all := make([]int, len(c.Components))
+		for i := range all {
+			all[i] = i
+		}
+		scans = []Scan{{Components: all, SpectralEnd: blockSize - 1}}
+	} else if len(scans) == 0 {
+		scans = defaultScans(len(c.Components))
+	} else if err := checkScans(scans, len(c.Components)); err != nil {
+		return err
+	}
+	if err := c.checkDC(scans); err != nil {
+		return err
+	}
+	var e encoder
+	e.w = toWriter(w)
+	e.ri = c.RestartInterval
+	// Share the quantization tables between components where possible.
+	var tq [maxComponents]uint8
+	for i, cc := range c.Components {
+		q := cc.Quant
+		if !c.ZigZag {
+			q = zigBlock(q)
+		}
+		var table [blockSize]uint16
+		for j, x := range q {
+			table[j] = uint16(x)
+		}
+		t := 0
+		for t < e.nQuant && e.quant[t] != table {
+			t++
+		}
+		if t == e.nQuant {
+			if t > maxTq {
+				return errors.New("jpeg: too many quantization tables")
+			}
+			e.quant[t] = table
+			e.nQuant++
+		}
+		tq[i] = uint8(t)
+	}
+
+	// Write the Start Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd8
+	e.write(e.buf[:2])
+	for _, m := range c.Metadata {
+		e.writeMarkerHeader(m.Marker, 2+len(m.Data))
+		e.write(m.Data)
+	}
+	if c.AdobeTransform >= 0 {
+		e.writeApp14(uint8(c.AdobeTransform))
+	}
+	e.writeDQT()
+	e.writeCoefficientsSOF(c, &tq)
+	if e.ri > 0 {
+		e.writeDRI()
+	}
+	for i := range scans {
+		e.writeScan(c, &scans[i], c.Progressive)
+	}
+	e.writeEOI()
+	return e.err
+}
+
+// check checks that c can be encoded by EncodeCoefficients.
+func (c *Coefficients) check() error {
+	if c.Width <= 0 || c.Height <= 0 || c.Width >= 1<<16 || c.Height >= 1<<16 {
+		return errors.New("jpeg: invalid image size")
+	}
+	if n := len(c.Components); n == 0 || n > maxComponents {
+		return errors.New("jpeg: invalid number of components")
+	}
+	if c.RestartInterval < 0 || c.RestartInterval >= 1<<16 {
+		return errors.New("jpeg: invalid RestartInterval")
+	}
+	if err := checkMetadata(c.Metadata); err != nil {
+		return err
+	}
+	hMax, vMax, totalHV := 1, 1, 0
+	for i, cc := range c.Components {
+		if cc.H < 1 || cc.H > 4 || cc.V < 1 || cc.V > 4 {
+			return errors.New("jpeg: invalid sampling factors")
+		}
+		hMax, vMax, totalHV = max(hMax, cc.H), max(vMax, cc.V), totalHV+cc.H*cc.V
+		for _, other := range c.Components[:i] {
+			if other.ID == cc.ID {
+				return errors.New("jpeg: repeated component identifier")
+			}
+		}
+		for _, x := range cc.Quant {
+			if x < 1 || x > 0xffff {
+				return errors.New("jpeg: invalid quantization table")
+			}
+		}
+	}
+	if len(c.Components) > 1 && totalHV > 10 {
+		return errors.New("jpeg: total sampling factors too large")
+	}
+	for i := range c.Components {
+		cc := &c.Components[i]
+		bw, bh := c.blocks(i, hMax, vMax)
+		if cc.BlocksWide < bw || cc.BlocksHigh < bh || len(cc.Blocks) != cc.BlocksWide*cc.BlocksHigh {
+			return errors.New("jpeg: too few blocks for the image size")
+		}
+		// Huffman coding has codes for AC values of up to 10 bits, which
+		// the DCT of 8-bit samples fits. Arithmetic coded images are held
+		// to the same limit. The DC deltas are checked by checkDC.
+		for k, b := range cc.Blocks {
+			for _, x := range b[1:] {
+				if x < -maxAC || x > maxAC {
+					return fmt.Errorf("jpeg: AC coefficient out of range in block %d of component %d", k, i)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// blocks returns the number of blocks across and down that the given
+// component's data has. For a single-component image, that is the blocks
+// that cover the image. Otherwise, it is the blocks in the MCUs that cover
+// the image. hMax and vMax are the maximum sampling factors.
+func (c *Coefficients) blocks(i, hMax, vMax int) (bw, bh int) {
+	cc := &c.Components[i]
+	if len(c.Components) == 1 {
+		return c.componentBlocks(i, hMax, vMax)
+	}
+	mxx := (c.Width + 8*hMax - 1) / (8 * hMax)
+	myy := (c.Height + 8*vMax - 1) / (8 * vMax)
+	return mxx * cc.H, myy * cc.V
+}
+
+// componentBlocks returns the number of blocks across and down that cover
+// the given component's samples, which are those in a non-interleaved scan.
+// hMax and vMax are the maximum sampling factors.
+func (c *Coefficients) componentBlocks(i, hMax, vMax int) (bw, bh int) {
+	cc := &c.Components[i]
+	w := (c.Width*cc.H + hMax - 1) / hMax
+	h := (c.Height*cc.V + vMax - 1) / vMax
+	return (w + 7) / 8, (h + 7) / 8
+}
+
+// writeApp14 writes an Adobe APP14 marker with the given color transform.
+func (e *encoder) writeApp14(transform uint8) {
+	e.writeMarkerHeader(app14Marker, 14)
+	// The "Adobe" identifier, version 100, zero flags and the transform.
+	copy(e.buf[:], "Adobe\x00\x64\x00\x00\x00\x00")
+	e.buf[11] = transform
+	e.write(e.buf[:12])
+}
+
+// writeCoefficientsSOF writes the Start Of Frame marker for c. A sequential
+// Huffman-coded image is baseline unless a quantization table has 16-bit
+// precision. tq is the quantization table of each component.
+func (e *encoder) writeCoefficientsSOF(c *Coefficients, tq *[maxComponents]uint8) {
+	marker := uint8(sof0Marker)
+	for i := range e.nQuant {
+		if quantPrecision(&e.quant[i]) != 1 {
+			marker = sof1Marker
+		}
+	}
+	switch {
+	case c.Progressive && c.Arithmetic:
+		marker = sof10Marker
+	case c.Progressive:
+		marker = sof2Marker
+	case c.Arithmetic:
+		marker = sof9Marker
+	}
+	nComponent := len(c.Components)
+	e.writeMarkerHeader(marker, 8+3*nComponent)
+	e.buf[0] = 8 // 8-bit color.
+	e.buf[1] = uint8(c.Height >> 8)
+	e.buf[2] = uint8(c.Height & 0xff)
+	e.buf[3] = uint8(c.Width >> 8)
+	e.buf[4] = uint8(c.Width & 0xff)
+	e.buf[5] = uint8(nComponent)
+	e.write(e.buf[:6])
+	for i, cc := range c.Components {
+		e.buf[0] = cc.ID
+		e.buf[1] = uint8(cc.H<<4 | cc.V)
+		e.buf[2] = tq[i]
+		e.write(e.buf[:3])
+	}
+}
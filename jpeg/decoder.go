@@ -0,0 +1,208 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+)
+
+// A Decoder decodes a sequence of JPEG images, such as the frames of a Motion
+// JPEG stream, reusing its buffers from one image to the next. When the
+// images have the same size and subsampling, decoding them with DecodeInto
+// does not allocate. A Decoder is not safe for concurrent use.
+type Decoder struct {
+	d    decoder
+	opts DecoderOptions
+}
+
+// NewDecoder returns a Decoder that decodes images with the given options.
+// Default parameters are used if a nil *[DecoderOptions] is passed.
+func NewDecoder(o *DecoderOptions) *Decoder {
+	dec := &Decoder{}
+	dec.Reset(o)
+	return dec
+}
+
+// Reset sets the options used to decode the next image. The buffers from
+// the previous image are kept for reuse.
+func (dec *Decoder) Reset(o *DecoderOptions) {
+	dec.opts = DecoderOptions{}
+	if o != nil {
+		dec.opts = *o
+	}
+}
+
+// Decode is like [DecodeContext]. The returned image shares its pixel
+// buffers with the Decoder, so it is only valid until the next call to
+// Decode or DecodeInto.
+func (dec *Decoder) Decode(ctx context.Context, r io.Reader) (image.Image, error) {
+	d := dec.start(ctx, nil)
+	img, err := d.decode(r, false)
+	return img, d.wrapError(err)
+}
+
+// DecodeInto is like Decode, but stores the image in dst, which must be an
+// *image.Gray for a grayscale image, or an *image.YCbCr with the image's
+// subsampling otherwise, with the bounds of the image that Decode would
+// return. CMYK and RGB images can not be decoded into dst. Errors such as
+// a *[DamagedError] that accompany an image with DecodeContext are returned
+// with dst holding the image.
+//
+// The image is decoded in whole MCUs (Minimum Coded Units), such as 16x16
+// pixels for 4:2:0 subsampling. If the image's width and height are
+// multiples of the MCU size, it is decoded straight into dst. Otherwise, it
+// is decoded into the Decoder's buffers, which are as large as the image,
+// and then copied to dst, which costs a copy of every pixel for each image.
+func (dec *Decoder) DecodeInto(ctx context.Context, r io.Reader, dst image.Image) error {
+	d := dec.start(ctx, dst)
+	_, err := d.decode(r, false)
+	return d.wrapError(err)
+}
+
+// start prepares the Decoder's decoder for a new image, keeping the buffers
+// from the previous image in its pool.
+func (dec *Decoder) start(ctx context.Context, dst image.Image) *decoder {
+	d := &dec.d
+	pool := d.pool
+	// Buffers shared with a DecodeInto destination are not the Decoder's
+	// to reuse.
+	if d.img1 != nil && d.img1 != &d.pool.dst1 {
+		pool.img1 = d.img1
+	}
+	if d.img3 != nil && d.img3 != &d.pool.dst3 {
+		pool.img3 = d.img3
+	}
+	pool.dst1, pool.dst3 = image.Gray{}, image.YCbCr{}
+	if d.blackPix != nil {
+		pool.blackPix = d.blackPix
+	}
+	for i, c := range d.progCoeffs {
+		if c != nil {
+			pool.coeffs[i] = c
+		}
+	}
+	*d = decoder{}
+	d.ctx, d.opts, d.dst = ctx, dec.opts, dst
+	d.pool, d.pooled = pool, true
+	return d
+}
+
+var errDstMismatch = errors.New("jpeg: DecodeInto destination does not match the image")
+
+// checkDst checks that the image can be stored in d.dst, if set.
+func (d *decoder) checkDst() error {
+	if d.dst == nil {
+		return nil
+	}
+	if d.dst.Bounds() != d.bounds {
+		return errDstMismatch
+	}
+	switch dst := d.dst.(type) {
+	case *image.Gray:
+		if d.img1 != nil {
+			return nil
+		}
+	case *image.YCbCr:
+		if d.img3 != nil && d.blackPix == nil && !d.isRGB() && dst.SubsampleRatio == d.img3.SubsampleRatio {
+			return nil
+		}
+	}
+	return errDstMismatch
+}
+
+// dstGray returns an image of r, the MCUs that overlap the image bounds,
+// that shares its pixels with d.dst, so that the image is decoded straight
+// into it. It returns nil unless d.dst is an *image.Gray with the image
+// bounds, which are r, as samples outside of d.dst's bounds, such as those
+// of a larger image that it is part of, must not be written.
+func (d *decoder) dstGray(r image.Rectangle) *image.Gray {
+	dst, ok := d.dst.(*image.Gray)
+	if !ok || dst.Rect != d.bounds || dst.Rect != r {
+		return nil
+	}
+	m := image.Gray{Stride: dst.Stride, Rect: r}
+	if m.Pix, ok = coverPlane(dst.Pix, m.Stride, r.Dx(), m.PixOffset(r.Max.X-1, r.Max.Y-1)); !ok {
+		return nil
+	}
+	d.pool.dst1 = m
+	return &d.pool.dst1
+}
+
+// dstYCbCr is like dstGray, for an image with the given subsampling. It
+// returns nil unless d.dst is an *image.YCbCr that checkDst accepts.
+func (d *decoder) dstYCbCr(r image.Rectangle, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	dst, ok := d.dst.(*image.YCbCr)
+	if !ok || dst.Rect != d.bounds || dst.Rect != r || dst.SubsampleRatio != ratio || d.nComp != 3 || d.isRGB() {
+		return nil
+	}
+	m := image.YCbCr{YStride: dst.YStride, CStride: dst.CStride, SubsampleRatio: ratio, Rect: r}
+	cw := m.COffset(r.Max.X-1, r.Min.Y) + 1
+	cLast := m.COffset(r.Max.X-1, r.Max.Y-1)
+	var okY, okCb, okCr bool
+	m.Y, okY = coverPlane(dst.Y, m.YStride, r.Dx(), m.YOffset(r.Max.X-1, r.Max.Y-1))
+	m.Cb, okCb = coverPlane(dst.Cb, m.CStride, cw, cLast)
+	m.Cr, okCr = coverPlane(dst.Cr, m.CStride, cw, cLast)
+	if !okY || !okCb || !okCr {
+		return nil
+	}
+	d.pool.dst3 = m
+	return &d.pool.dst3
+}
+
+// coverPlane returns pix up to the sample at offset last, if pix has it and
+// its rows, of width samples, don't overlap with the given stride. The
+// samples after last may be those of a larger image.
+func coverPlane(pix []byte, stride, width, last int) ([]byte, bool) {
+	if stride < width || last >= len(pix) {
+		return nil, false
+	}
+	return pix[:last+1], true
+}
+
+// decodesIntoDst returns whether the image is decoded straight into d.dst,
+// rather than copied to it.
+func (d *decoder) decodesIntoDst() bool {
+	return d.img1 == &d.pool.dst1 || d.img3 == &d.pool.dst3
+}
+
+// copyToDst copies the decoded image to d.dst, which checkDst has checked.
+func (d *decoder) copyToDst() {
+	r := d.bounds
+	if d.img1 != nil {
+		dst := d.dst.(*image.Gray)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			copy(dst.Pix[dst.PixOffset(r.Min.X, y):][:r.Dx()], d.img1.Pix[d.img1.PixOffset(r.Min.X, y):])
+		}
+		return
+	}
+	src, dst := d.img3, d.dst.(*image.YCbCr)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		copy(dst.Y[dst.YOffset(r.Min.X, y):][:r.Dx()], src.Y[src.YOffset(r.Min.X, y):])
+	}
+	// Copy the chroma samples that the bounds overlap.
+	h, v := 1, 1
+	switch src.SubsampleRatio {
+	case image.YCbCrSubsampleRatio422:
+		h = 2
+	case image.YCbCrSubsampleRatio420:
+		h, v = 2, 2
+	case image.YCbCrSubsampleRatio440:
+		v = 2
+	case image.YCbCrSubsampleRatio411:
+		h = 4
+	case image.YCbCrSubsampleRatio410:
+		h, v = 4, 2
+	}
+	cw := (r.Max.X+h-1)/h - r.Min.X/h
+	for cy := r.Min.Y / v; cy < (r.Max.Y+v-1)/v; cy++ {
+		y := max(cy*v, r.Min.Y)
+		si, di := src.COffset(r.Min.X, y), dst.COffset(r.Min.X, y)
+		copy(dst.Cb[di:di+cw], src.Cb[si:])
+		copy(dst.Cr[di:di+cw], src.Cr[si:])
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+// EditMetadata reads a JPEG image from r and writes it to w with its APPn and
+// COM segments replaced by those that edit returns when passed them, in
+// order. That can remove, insert, replace or reorder segments. The segments
+// passed to edit, and copies of them, even with other Data, are written
+// where they were in the input, and other segments are written straight
+// after the SOI marker. The other segments of the input, and the
+// entropy-coded data, are copied unchanged, so that the image loses no
+// quality. Errors are as for [DecodeContext], or as returned by edit.
+func EditMetadata(ctx context.Context, w io.Writer, r io.Reader, edit func([]Segment) ([]Segment, error)) error {
+	var segments, metadata []Segment
+	var scans [][]byte
+	d := decoder{ctx: ctx, segmentFunc: func(s *SegmentInfo) error {
+		switch {
+		case s.Length == 0:
+			// The SOI and EOI markers are written anew, and RST markers
+			// outside a scan are dropped.
+		case isMetadataMarker(s.Marker):
+			m := s.Segment
+			m.pos = len(segments) + 1
+			metadata = append(metadata, m)
+		default:
+			segments = append(segments, s.Segment)
+			scans = append(scans, s.Scan)
+		}
+		return nil
+	}}
+	if _, err := d.decode(r, false); err != nil {
+		return d.wrapError(err)
+	}
+	metadata, err := edit(metadata)
+	if err != nil {
+		return err
+	}
+	if err := checkMetadata(metadata); err != nil {
+		return err
+	}
+
+	var e encoder
+	e.w = toWriter(w)
+	// Write the Start Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd8
+	e.write(e.buf[:2])
+	for i := 0; i <= len(segments); i++ {
+		for _, m := range metadata {
+			if max(m.pos, 1) == i+1 {
+				e.writeMarkerHeader(m.Marker, 2+len(m.Data))
+				e.write(m.Data)
+			}
+		}
+		if i < len(segments) {
+			e.writeMarkerHeader(segments[i].Marker, 2+len(segments[i].Data))
+			e.write(segments[i].Data)
+			e.write(scans[i])
+		}
+	}
+	e.writeEOI()
+	return e.err
+}
+
+// checkMetadata checks that segments are APPn or COM segments that fit in a
+// marker segment.
+func checkMetadata(segments []Segment) error {
+	for _, m := range segments {
+		if !isMetadataMarker(m.Marker) || len(m.Data) > 0xffff-2 {
+			return errors.New("jpeg: invalid metadata segment")
+		}
+	}
+	return nil
+}
+
+// SegmentKind is the kind of metadata that an APPn or COM segment holds.
+type SegmentKind int
+
+const (
+	// OtherSegment is a segment of an unrecognized kind.
+	OtherSegment SegmentKind = iota
+	// JFIFSegment is a JFIF APP0 segment.
+	JFIFSegment
+	// ExifSegment is an APP1 segment holding Exif metadata.
+	ExifSegment
+	// XMPSegment is an APP1 segment holding an XMP packet, or part of an
+	// extended one.
+	XMPSegment
+	// ICCSegment is an APP2 segment holding part of an ICC color profile.
+	ICCSegment
+	// AdobeSegment is an Adobe APP14 segment, which holds the color
+	// transform.
+	AdobeSegment
+	// CommentSegment is a COM segment, which holds a text comment.
+	CommentSegment
+)
+
+// The identifiers at the start of the data of metadata segments.
+const (
+	exifID        = "Exif\x00\x00"
+	xmpID         = "http://ns.adobe.com/xap/1.0/\x00"
+	xmpExtendedID = "http://ns.adobe.com/xmp/extension/\x00"
+	iccID         = "ICC_PROFILE\x00"
+)
+
+// Kind returns the kind of metadata that s holds, from its marker and
+// identifier.
+func (s Segment) Kind() SegmentKind {
+	data := string(s.Data)
+	switch {
+	case s.Marker == app0Marker && strings.HasPrefix(data, "JFIF\x00"):
+		return JFIFSegment
+	case s.Marker == app1Marker && strings.HasPrefix(data, exifID):
+		return ExifSegment
+	case s.Marker == app1Marker && (strings.HasPrefix(data, xmpID) || strings.HasPrefix(data, xmpExtendedID)):
+		return XMPSegment
+	case s.Marker == app2Marker && strings.HasPrefix(data, iccID):
+		return ICCSegment
+	case s.Marker == app14Marker && strings.HasPrefix(data, "Adobe"):
+		return AdobeSegment
+	case s.Marker == comMarker:
+		return CommentSegment
+	}
+	return OtherSegment
+}
+
+// NewExifSegment returns an APP1 segment holding the Exif metadata exif,
+// which is a TIFF header and the image file directories after it.
+func NewExifSegment(exif []byte) Segment {
+	return Segment{Marker: app1Marker, Data: append([]byte(exifID), exif...)}
+}
+
+// NewXMPSegment returns an APP1 segment holding the XMP packet xmp, which
+// must fit in a single segment.
+func NewXMPSegment(xmp []byte) Segment {
+	return Segment{Marker: app1Marker, Data: append([]byte(xmpID), xmp...)}
+}
+
+// maxICCChunk is the largest part of an ICC profile that an APP2 segment
+// holds, after its identifier and the chunk's number and count.
+const maxICCChunk = 0xffff - 2 - len(iccID) - 2
+
+// NewICCSegments returns the APP2 segments that hold the ICC color profile
+// icc, split into chunks as per the ICC specification, annex B.4.
+func NewICCSegments(icc []byte) ([]Segment, error) {
+	n := (len(icc) + maxICCChunk - 1) / maxICCChunk
+	if n == 0 || n > 255 {
+		return nil, errors.New("jpeg: invalid ICC profile size")
+	}
+	segments := make([]Segment, n)
+	for i := range segments {
+		chunk := icc[i*maxICCChunk : min(len(icc), (i+1)*maxICCChunk)]
+		data := append([]byte(iccID), uint8(i+1), uint8(n))
+		segments[i] = Segment{Marker: app2Marker, Data: append(data, chunk...)}
+	}
+	return segments, nil
+}
@@ -86,6 +86,36 @@ func (d *decoder) receiveExtend(t uint8) (int32, error) {
 	return x, nil
 }
 
+// skipAC advances past the AC coefficients of a sequential block, for
+// previews. Only the Huffman codes are decoded. The magnitude bits that follow
+// them are skipped.
+func (d *decoder) skipAC(h *huffman) error {
+	for zig := 1; zig < blockSize; zig++ {
+		value, err := d.decodeHuffman(h)
+		if err != nil {
+			return err
+		}
+		val0 := int(value >> 4)
+		val1 := int32(value & 0x0f)
+		if val1 == 0 {
+			if val0 != 0x0f {
+				return nil // End Of Block.
+			}
+			zig += 15
+			continue
+		}
+		zig += val0
+		if d.bits.n < val1 {
+			if err := d.ensureNBits(val1); err != nil {
+				return err
+			}
+		}
+		d.bits.n -= val1
+		d.bits.m >>= val1
+	}
+	return nil
+}
+
 // processDHT processes a Define Huffman Table marker, and initializes a huffman
 // struct from its contents. Specified in section B.2.4.2.
 func (d *decoder) processDHT(n int) error {
@@ -0,0 +1,267 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"io"
+	"sync"
+)
+
+// errIntervalEnd means that a restart interval's data did not end where its
+// restart marker is.
+var errIntervalEnd = FormatError("restart interval has extraneous data")
+
+// decodesIntervals returns whether the scan s is decoded by decodeIntervals.
+// Its restart intervals are independent of each other, and are decoded
+// straight into the image, if it is a sequential Huffman-coded scan whose
+// MCUs are those of the image: all of the components, or grayscale.
+func (d *decoder) decodesIntervals(s *scanState) bool {
+	return d.opts.Workers > 1 && d.ri > 0 && !d.progressive && !d.arithmetic &&
+		!d.keepCoeffs && !d.streaming && (s.nComp == d.nComp || d.nComp == 1)
+}
+
+// decodeIntervals decodes the scan s, using d.opts.Workers goroutines that
+// each decode one restart interval at a time. The whole of the scan's data is
+// read first, to find the restart markers. If the data is not as expected,
+// such as a restart marker being missing, or any interval fails to decode,
+// the data is rewound and decodeIntervals returns false, so that the scan is
+// decoded serially instead. That way, any error or warning is the same as
+// without the Workers option.
+func (d *decoder) decodeIntervals(s *scanState) (bool, error) {
+	start := d.offset()
+	data, ends, err := d.readScanData()
+	if err == io.ErrUnexpectedEOF {
+		d.rewind(data, start)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	n := (s.mxx*s.myy + d.ri - 1) / d.ri
+	if len(ends) != n {
+		d.rewind(data, start)
+		return false, nil
+	}
+	for k, end := range ends[:n-1] {
+		if data[end+1] != rst0Marker+uint8(k%8) {
+			d.rewind(data, start)
+			return false, nil
+		}
+	}
+
+	errs := make([]error, n)
+	damaged := make([][]image.Rectangle, n)
+	intervals := make(chan int)
+	var wg sync.WaitGroup
+	for range min(d.opts.Workers, n) {
+		w := *d
+		wg.Go(func() {
+			for k := range intervals {
+				begin := 0
+				if k > 0 {
+					begin = ends[k-1] + 2
+				}
+				w.damaged = nil
+				errs[k] = w.decodeInterval(s, k, data[begin:ends[k]+2], start+int64(begin))
+				damaged[k] = w.damaged
+			}
+		})
+	}
+	for k := range n {
+		intervals <- k
+	}
+	close(intervals)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			d.rewind(data, start)
+			if d.opts.Partial {
+				for i := 0; i < d.nComp; i++ {
+					d.fillComponent(i, 0x80)
+				}
+			}
+			return false, nil
+		}
+	}
+	// Leave the marker after the scan to be read again.
+	d.unreadMarker()
+	for _, regions := range damaged {
+		for _, r := range regions {
+			d.addDamage(r)
+		}
+	}
+	if d.opts.Progress != nil {
+		for my := 0; my < s.myy; my++ {
+			d.opts.Progress(Progress{
+				Scan:    d.nScan,
+				MCURow:  my + 1,
+				MCURows: s.myy,
+				Offset:  d.offset(),
+			})
+		}
+	}
+	return true, nil
+}
+
+// decodeInterval decodes the k'th restart interval of the scan s from data,
+// which is followed by the marker after the interval. off is the offset of
+// data in the input. d is a copy of the decoder that is used by one goroutine
+// of decodeIntervals, and s0 is not modified.
+func (d *decoder) decodeInterval(s0 *scanState, k int, data []byte, off int64) error {
+	d.r = bytes.NewReader(data)
+	d.bytes.i, d.bytes.j, d.bytes.nUnreadable, d.bytes.off = 0, 0, 0, off
+	d.bits = bits{}
+	d.eobRun = 0
+	s := *s0
+	s.mcu = k * d.ri
+	if d.intervalOutside(&s) {
+		return nil
+	}
+	for end := min(s.mcu+d.ri, s.mxx*s.myy); s.mcu < end; s.mcu++ {
+		mx, my := s.mcu%s.mxx, s.mcu/s.mxx
+		if mx == 0 {
+			if err := d.checkContext(); err != nil {
+				return err
+			}
+		}
+		d.mcu = image.Point{mx, my}
+		if err := d.decodeMCU(&s, mx, my); err != nil {
+			return err
+		}
+	}
+	if s.skip {
+		// The rest of the interval was corrupt, and resyncRST would skip to
+		// the marker.
+		return nil
+	}
+	if err := d.readFull(d.tmp[:2]); err != nil {
+		return err
+	}
+	if d.offset() != off+int64(len(data)) {
+		return errIntervalEnd
+	}
+	return nil
+}
+
+// readScanData reads the rest of a scan's entropy-coded data, up to and
+// including the next marker that is not RST[0-7]. It returns the data, and
+// the indexes in it of the 0xff byte of each RST[0-7] marker and of that
+// final marker. If the input ends first, the data so far is returned along
+// with the error.
+func (d *decoder) readScanData() (data []byte, ends []int, err error) {
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return data, ends, err
+		}
+		data = append(data, c)
+		if c != 0xff {
+			continue
+		}
+		for c == 0xff {
+			if c, err = d.readByte(); err != nil {
+				return data, ends, err
+			}
+			data = append(data, c)
+		}
+		if c == 0x00 {
+			continue
+		}
+		ends = append(ends, len(data)-2)
+		if c < rst0Marker || rst7Marker < c {
+			return data, ends, nil
+		}
+	}
+}
+
+// rewind makes the decoder read data again, before the rest of its input.
+// data was read from the input starting at offset off.
+func (d *decoder) rewind(data []byte, off int64) {
+	rest := bytes.Clone(d.bytes.buf[d.bytes.i:d.bytes.j])
+	d.r = io.MultiReader(bytes.NewReader(data), bytes.NewReader(rest), d.r)
+	d.bytes.i, d.bytes.j, d.bytes.nUnreadable, d.bytes.off = 0, 0, 0, off
+}
+
+// reconstructConcurrently is reconstructCoeffs for the Workers option. It
+// uses d.opts.Workers goroutines that each reconstruct one MCU row of one
+// component at a time. The blocks, and the pixels that they are written to,
+// are disjoint, so the result is the same as reconstructing them serially.
+func (d *decoder) reconstructConcurrently(my0, my1 int, intermediate bool) error {
+	type job struct{ i, my int }
+	jobs := make(chan job)
+	errs := make([]error, d.nComp*(my1-my0))
+	var wg sync.WaitGroup
+	for range min(d.opts.Workers, len(errs)) {
+		wg.Go(func() {
+			for j := range jobs {
+				errs[j.i*(my1-my0)+j.my-my0] = d.reconstructComponent(j.i, j.my, j.my+1, intermediate)
+			}
+		})
+	}
+	for i := 0; i < d.nComp; i++ {
+		if d.progCoeffs[i] == nil {
+			continue
+		}
+		for my := my0; my < my1; my++ {
+			jobs <- job{i, my}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeIntervals writes the MCUs of m, using e.workers goroutines that each
+// encode one restart interval at a time into its own buffer. The buffers are
+// then written in order, separated by RST markers, which gives the same
+// output as writing the MCUs serially.
+func (e *encoder) writeIntervals(m image.Image) {
+	bounds := m.Bounds()
+	size := mcuSize(m)
+	mxx := (bounds.Dx() + size - 1) / size
+	myy := (bounds.Dy() + size - 1) / size
+	n := (mxx*myy + e.ri - 1) / e.ri
+	bufs := make([]bytes.Buffer, n)
+	intervals := make(chan int)
+	var wg sync.WaitGroup
+	for range min(e.workers, n) {
+		wg.Go(func() {
+			for k := range intervals {
+				w := encoder{w: bufio.NewWriter(&bufs[k]), quant: e.quant, nQuant: e.nQuant, huff: e.huff}
+				end := min((k+1)*e.ri, mxx*myy)
+				for i := k * e.ri; i < end; {
+					mx, my := i%mxx, i/mxx
+					mx1 := min(mxx, mx+end-i)
+					w.writeMCUs(m, bounds.Min.Y+my*size, mx, mx1)
+					i += mx1 - mx
+				}
+				w.padBits()
+				w.flush()
+			}
+		})
+	}
+	for k := range n {
+		intervals <- k
+	}
+	close(intervals)
+	wg.Wait()
+
+	for k := range bufs {
+		if k > 0 {
+			e.nMCU = k * e.ri
+			e.writeRST()
+		}
+		e.write(bufs[k].Bytes())
+	}
+	e.nMCU = mxx * myy
+}
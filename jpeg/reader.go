@@ -8,6 +8,9 @@
 package jpeg
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"io"
@@ -23,6 +26,39 @@ type UnsupportedError string
 
 func (e UnsupportedError) Error() string { return "unsupported JPEG feature: " + string(e) }
 
+// An Error is a FormatError or UnsupportedError, together with where in the
+// input it was found. It is returned by [DecodeContext]. For compatibility,
+// [Decode] and [DecodeConfig] return the bare FormatError or
+// UnsupportedError.
+type Error struct {
+	// Err is the FormatError, UnsupportedError or *StrictError.
+	Err error
+	// Offset is the number of bytes consumed from the input when the error
+	// was found.
+	Offset int64
+	// Marker is the marker of the segment being processed, such as 0xdb for
+	// DQT, or zero if the error was found between segments.
+	Marker byte
+	// Scan is the index of the scan being processed, starting at zero, and
+	// MCU is the column and row of the MCU being decoded. They are only
+	// meaningful when Marker is 0xda (SOS).
+	Scan int
+	MCU  image.Point
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+	if e.Marker != 0 {
+		s += " in " + markerName(e.Marker) + " segment"
+	}
+	if e.Marker == sosMarker {
+		s += fmt.Sprintf(" (scan %d, MCU %d,%d)", e.Scan, e.MCU.X, e.MCU.Y)
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
 var errUnsupportedSubsamplingRatio = UnsupportedError("luma/chroma subsampling ratio")
 
 // Component specification, specified in section B.2.2.
@@ -72,6 +108,8 @@ const (
 	// but in practice, their use is described at
 	// https://www.sno.phy.queensu.ca/~phil/exiftool/TagNames/JPEG.html
 	app0Marker  = 0xe0
+	app1Marker  = 0xe1
+	app2Marker  = 0xe2
 	app14Marker = 0xee
 	app15Marker = 0xef
 )
@@ -144,6 +182,8 @@ type decoder struct {
 		// nUnreadable is the number of bytes to back up i after
 		// overshooting. It can be 0, 1 or 2.
 		nUnreadable int
+		// off is the offset in the underlying io.Reader of buf[0].
+		off int64
 	}
 	width, height int
 
@@ -176,6 +216,71 @@ type decoder struct {
 	arithAcCond [maxTb + 1]arithmeticAcConditioning
 	quant       [maxTq + 1]block // Quantization tables, in zig-zag order.
 	tmp         [2 * blockSize]byte
+
+	ctx   context.Context // Checked for cancellation, if non-nil.
+	opts  DecoderOptions
+	nScan int // The number of scans processed so far.
+
+	// blockDim is the width and height, in pixels, that each 8x8 block is
+	// decoded to: 8, or 4, 2 or 1 when scaling.
+	blockDim int
+	// bounds is the bounds of the decoded image, and cropMCUs is the MCUs
+	// that overlap it. The img1 and img3 buffers cover the MCUs in mcus,
+	// which is cropMCUs, or one row of it when streaming.
+	bounds   image.Rectangle
+	cropMCUs image.Rectangle
+	mcus     image.Rectangle
+
+	// streaming is whether a RowReader is decoding the image one MCU row at
+	// a time. If so, streamScan is the scan that it decodes, unless
+	// keepCoeffs is set, in which case every scan is decoded into
+	// progCoeffs and the rows are reconstructed from them.
+	streaming  bool
+	streamScan *scanState
+	keepCoeffs bool
+
+	// marker and mcu are the current segment's marker, or zero between
+	// segments, and the current MCU within a scan. They are reported by
+	// wrapError.
+	marker uint8
+	mcu    image.Point
+
+	damaged []image.Rectangle // Regions skipped by resynchronization.
+
+	// scan is the state of the current scan.
+	scan scanState
+
+	// coeffsOnly is whether DecodeCoefficients is decoding the image's
+	// coefficients into progCoeffs, without reconstructing it. If so, scans
+	// records the scans.
+	coeffsOnly bool
+	scans      []Scan
+	// keepMetadata is whether the APPn and COM segments are kept in
+	// metadata, other than an Adobe APP14 segment.
+	keepMetadata bool
+	metadata     []Segment
+	// segmentFunc, if not nil, is called with each segment, undecoded,
+	// instead of the segments being processed.
+	segmentFunc func(*SegmentInfo) error
+	// tablesOnly is whether DecodeTables is decoding a tables-only stream,
+	// which has no image.
+	tablesOnly bool
+
+	// pool holds the buffers of the previous image decoded by a Decoder,
+	// which are reused if they are the right size. pooled is whether they
+	// might be. dst is the image that Decoder.DecodeInto decodes into, and
+	// dst1 or dst3 shares its pixels when the image is decoded straight into
+	// it.
+	pool struct {
+		img1     *image.Gray
+		img3     *image.YCbCr
+		blackPix []byte
+		coeffs   [maxComponents][]block
+		dst1     image.Gray
+		dst3     image.YCbCr
+	}
+	pooled bool
+	dst    image.Image
 }
 
 // fill fills up the d.bytes.buf buffer from the underlying io.Reader. It
@@ -187,6 +292,7 @@ func (d *decoder) fill() error {
 	// Move the last 2 bytes to the start of the buffer, in case we need
 	// to call unreadByteStuffedByte.
 	if d.bytes.j > 2 {
+		d.bytes.off += int64(d.bytes.j - 2)
 		d.bytes.buf[0] = d.bytes.buf[d.bytes.j-2]
 		d.bytes.buf[1] = d.bytes.buf[d.bytes.j-1]
 		d.bytes.i, d.bytes.j = 2, 2
@@ -203,6 +309,20 @@ func (d *decoder) fill() error {
 	return err
 }
 
+// offset returns the offset in the underlying io.Reader of the next byte to
+// be read from d.bytes. Bytes that have been moved into d.bits count as read.
+func (d *decoder) offset() int64 {
+	return d.bytes.off + int64(d.bytes.i)
+}
+
+// checkContext returns the context's error, if the decode has been canceled.
+func (d *decoder) checkContext() error {
+	if d.ctx == nil {
+		return nil
+	}
+	return d.ctx.Err()
+}
+
 // unreadByteStuffedByte undoes the most recent readByteStuffedByte call,
 // giving a byte of data back from d.bits to d.bytes. The Huffman look-up table
 // requires at least 8 bits for look-up, which means that Huffman decoding can
@@ -234,7 +354,9 @@ func (d *decoder) readByte() (x byte, err error) {
 
 // errMissingFF00 means that readByteStuffedByte encountered an 0xff byte (a
 // marker byte) that wasn't the expected byte-stuffed sequence 0xff, 0x00.
-var errMissingFF00 = FormatError("missing 0xff00 sequence")
+// It is an error, rather than a FormatError, so that returning it doesn't
+// allocate.
+var errMissingFF00 error = FormatError("missing 0xff00 sequence")
 
 // readByteStuffedByte is like readByte but is for byte-stuffed Huffman data.
 func (d *decoder) readByteStuffedByte() (x byte, err error) {
@@ -248,6 +370,7 @@ func (d *decoder) readByteStuffedByte() (x byte, err error) {
 		}
 		if d.bytes.buf[d.bytes.i] != 0x00 {
 			d.bytes.i--
+			d.bytes.nUnreadable = 0
 			return 0, errMissingFF00
 		}
 		d.bytes.i++
@@ -270,11 +393,13 @@ func (d *decoder) readByteStuffedByte() (x byte, err error) {
 	if err != nil {
 		return 0, err
 	}
-	d.bytes.nUnreadable = 2
 	if x != 0x00 {
-		d.unreadByteStuffedByte()
+		// Leave the marker to be read again. The d.fill method keeps the
+		// last two bytes of the buffer, so this is always possible.
+		d.bytes.i -= 2
 		return 0, errMissingFF00
 	}
+	d.bytes.nUnreadable = 2
 	return 0xff, nil
 }
 
@@ -549,9 +674,52 @@ func (d *decoder) processApp14Marker(n int) error {
 	return nil
 }
 
+// isMetadataMarker returns whether marker is an APPn or COM marker.
+func isMetadataMarker(marker uint8) bool {
+	return app0Marker <= marker && marker <= app15Marker || marker == comMarker
+}
+
+// processMetadata reads an APPn or COM segment into d.metadata. JFIF APP0
+// and Adobe APP14 segments are processed as usual, but an Adobe segment is
+// not kept, as its color transform is kept separately.
+func (d *decoder) processMetadata(marker uint8, n int) error {
+	data := make([]byte, n)
+	if err := d.readFull(data); err != nil {
+		return err
+	}
+	switch {
+	case marker == app0Marker && n >= 5:
+		d.jfif = string(data[:5]) == "JFIF\x00"
+	case marker == app14Marker && n >= 12 && string(data[:5]) == "Adobe":
+		d.adobeTransformValid = true
+		d.adobeTransform = data[11]
+		return nil
+	}
+	d.metadata = append(d.metadata, Segment{Marker: marker, Data: data})
+	return nil
+}
+
 // decode reads a JPEG image from r and returns it as an image.Image.
-func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
+func (d *decoder) decode(r io.Reader, configOnly bool) (img image.Image, err error) {
 	d.r = r
+	switch d.opts.Scale {
+	case 0, 1:
+		d.blockDim = 8
+	case 2, 4, 8:
+		d.blockDim = 8 / d.opts.Scale
+	default:
+		return nil, errors.New("jpeg: invalid Scale option")
+	}
+	if d.opts.Preview {
+		d.blockDim = 1
+	}
+	if d.opts.Partial && !configOnly {
+		defer func() {
+			if err != nil {
+				img, err = d.partialImage(img, err)
+			}
+		}()
+	}
 
 	// Check for the Start Of Image marker.
 	if err := d.readFull(d.tmp[:2]); err != nil {
@@ -560,20 +728,36 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 	if d.tmp[0] != 0xff || d.tmp[1] != soiMarker {
 		return nil, FormatError("missing SOI marker")
 	}
+	if err := d.processStandaloneMarker(soiMarker); err != nil {
+		return nil, err
+	}
 
 	// Initialize Arithmetic conditioning
-	for t := range maxTb {
-		d.arithDcCond[t].lower = 0
-		d.arithDcCond[t].upper = 1 << 1
-		d.arithAcCond[t].kx = 5
+	for t := range d.arithDcCond {
+		d.arithDcCond[t] = defaultDcConditioning
+		d.arithAcCond[t] = defaultAcConditioning
+	}
+	if t := d.opts.Tables; t != nil {
+		d.huff, d.quant = t.huff, t.quant
+		d.arithDcCond, d.arithAcCond = t.arithDcCond, t.arithAcCond
 	}
 
+	return d.decodeSegments(configOnly)
+}
+
+// decodeSegments processes the segments after the SOI marker, until the EOI
+// marker, and returns the decoded image. When streaming, it returns a nil
+// image instead, and also returns early at the scan to stream.
+func (d *decoder) decodeSegments(configOnly bool) (img image.Image, err error) {
 	// Process the remaining segments until the End Of Image marker.
+segments:
 	for {
+		d.marker = 0
 		err := d.readFull(d.tmp[:2])
 		if err != nil {
 			return nil, err
 		}
+		start, skipped := d.offset()-2, int64(0)
 		for d.tmp[0] != 0xff {
 			// Strictly speaking, this is a format error. However, libjpeg is
 			// liberal in what it accepts. As of version 9, next_marker in
@@ -588,7 +772,7 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 			// print a warning).
 			//
 			// We are therefore also liberal in what we accept. Extraneous data
-			// is silently ignored.
+			// is ignored, apart from being reported to the Warn callback.
 			//
 			// This is similar to, but not exactly the same as, the restart
 			// mechanism within a scan (the RST[0-7] markers).
@@ -600,12 +784,22 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 			if err != nil {
 				return nil, err
 			}
+			skipped++
+		}
+		if skipped > 0 {
+			if err := d.warn(ExtraneousData, start, skipped); err != nil {
+				return nil, err
+			}
 		}
 		marker := d.tmp[1]
 		if marker == 0 {
 			// Treat "\xff\x00" as extraneous data.
+			if err := d.warn(StuffedZero, d.offset()-2, 2); err != nil {
+				return nil, err
+			}
 			continue
 		}
+		start, skipped = d.offset()-2, 0
 		for marker == 0xff {
 			// Section B.1.1.2 says, "Any marker may optionally be preceded by any
 			// number of fill bytes, which are bytes assigned code X'FF'".
@@ -613,8 +807,18 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 			if err != nil {
 				return nil, err
 			}
+			skipped++
+		}
+		if skipped > 0 {
+			if err := d.warn(FillBytes, start, skipped); err != nil {
+				return nil, err
+			}
 		}
+		d.marker = marker
 		if marker == eoiMarker { // End Of Image.
+			if err := d.processStandaloneMarker(marker); err != nil {
+				return nil, err
+			}
 			break
 		}
 		if rst0Marker <= marker && marker <= rst7Marker {
@@ -624,6 +828,12 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 			// marker. That restart marker will be seen here instead of inside the processSOS
 			// method, and is ignored as a harmless error. Restart markers have no extra data,
 			// so we check for this before we read the 16-bit length of the segment.
+			if err := d.warn(TrailingRST, d.offset()-2, 2); err != nil {
+				return nil, err
+			}
+			if err := d.processStandaloneMarker(marker); err != nil {
+				return nil, err
+			}
 			continue
 		}
 
@@ -637,6 +847,32 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 			return nil, FormatError("short segment length")
 		}
 
+		if d.segmentFunc != nil {
+			if err = d.processRawSegment(marker, n); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if d.keepMetadata && isMetadataMarker(marker) {
+			if err = d.processMetadata(marker, n); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// A tables-only stream has no SOFn or SOS segments, as per section
+		// B.5.
+		isSOF := sof0Marker <= marker && marker <= sof15Marker && marker != dhtMarker && marker != dacMarker
+		if d.tablesOnly && (isSOF || marker == sosMarker) {
+			return nil, FormatError("image data in tables-only stream")
+		}
+		// Without scans, cancellation is checked between segments instead.
+		if d.tablesOnly {
+			if err = d.checkContext(); err != nil {
+				return nil, err
+			}
+		}
+
 		switch marker {
 		case sof0Marker, sof1Marker, sof2Marker, sof9Marker, sof10Marker:
 			d.baseline = marker == sof0Marker
@@ -672,7 +908,22 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 			if configOnly {
 				return nil, nil
 			}
-			err = d.processSOS(n)
+			if err = d.checkContext(); err != nil {
+				return nil, err
+			}
+			if err = d.processSOS(n); err != nil {
+				break
+			}
+			d.nScan++
+			if d.streamScan != nil {
+				return nil, nil
+			}
+			if d.previewDone() {
+				break segments
+			}
+			if d.progressive && d.opts.Intermediate != nil {
+				err = d.renderIntermediate()
+			}
 		case driMarker:
 			if configOnly {
 				err = d.ignore(n)
@@ -684,7 +935,7 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 		case app14Marker:
 			err = d.processApp14Marker(n)
 		default:
-			if app0Marker <= marker && marker <= app15Marker || marker == comMarker {
+			if isMetadataMarker(marker) {
 				err = d.ignore(n)
 			} else if marker < 0xc0 { // See Table B.1 "Marker code assignments".
 				err = FormatError("unknown marker")
@@ -697,13 +948,147 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 		}
 	}
 
-	if d.progressive {
-		if err := d.reconstructProgressiveImage(); err != nil {
+	if d.streaming || d.coeffsOnly || d.segmentFunc != nil || d.tablesOnly {
+		return nil, nil
+	}
+	if d.keepCoeffs {
+		if err := d.reconstructProgressiveImage(false); err != nil {
+			return nil, err
+		}
+	}
+	img, err = d.image()
+	if err == nil && len(d.damaged) > 0 {
+		err = &DamagedError{Regions: d.damaged}
+	}
+	return img, err
+}
+
+// imageBounds returns the bounds of the decoded image. It is the size of the
+// JPEG image divided by the Scale option, rounded up, and then intersected
+// with the Crop option, if any.
+func (d *decoder) imageBounds() (image.Rectangle, error) {
+	bd := d.blockDim
+	r := image.Rect(0, 0, (d.width*bd+7)/8, (d.height*bd+7)/8)
+	if !d.opts.Crop.Empty() {
+		r = r.Intersect(d.opts.Crop)
+		if r.Empty() {
+			return image.Rectangle{}, errors.New("jpeg: Crop rectangle is outside the image")
+		}
+	}
+	return r, nil
+}
+
+// wrapError returns err as an *Error, with the position in the input, if it
+// is a FormatError or UnsupportedError. Other errors are returned unchanged.
+func (d *decoder) wrapError(err error) error {
+	switch err.(type) {
+	case FormatError, UnsupportedError, *StrictError:
+		return &Error{
+			Err:    err,
+			Offset: d.offset(),
+			Marker: d.marker,
+			Scan:   d.nScan,
+			MCU:    d.mcu,
+		}
+	}
+	return err
+}
+
+// markerName returns the name of a marker, such as "DQT" for 0xdb.
+func markerName(marker uint8) string {
+	switch {
+	case marker == dhtMarker:
+		return "DHT"
+	case marker == dacMarker:
+		return "DAC"
+	case sof0Marker <= marker && marker <= sof15Marker:
+		return fmt.Sprintf("SOF%d", marker-sof0Marker)
+	case rst0Marker <= marker && marker <= rst7Marker:
+		return fmt.Sprintf("RST%d", marker-rst0Marker)
+	case marker == soiMarker:
+		return "SOI"
+	case marker == eoiMarker:
+		return "EOI"
+	case marker == sosMarker:
+		return "SOS"
+	case marker == dqtMarker:
+		return "DQT"
+	case marker == driMarker:
+		return "DRI"
+	case app0Marker <= marker && marker <= app15Marker:
+		return fmt.Sprintf("APP%d", marker-app0Marker)
+	case marker == comMarker:
+		return "COM"
+	}
+	return fmt.Sprintf("0x%02x", marker)
+}
+
+// warn reports an anomaly in the input that the decoder tolerates. It calls
+// the Warn callback, if any, and returns an error if the Strict option is set.
+// The n bytes at offset off are the anomaly.
+func (d *decoder) warn(kind WarningKind, off, n int64) error {
+	w := Warning{Kind: kind, Offset: off, Len: n}
+	if d.opts.Warn != nil {
+		d.opts.Warn(w)
+	}
+	if d.opts.Strict && kind != FillBytes {
+		return &StrictError{Warning: w}
+	}
+	return nil
+}
+
+// partialImage returns the image decoded so far, if err means that the input
+// was truncated after the image was allocated. Samples that were not reached
+// are mid gray, as makeImg pre-fills them when the Partial option is set.
+// Other errors, such as a *DamagedError, are returned with img unchanged.
+func (d *decoder) partialImage(img image.Image, err error) (image.Image, error) {
+	if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, errShortHuffmanData) {
+		return img, err
+	}
+	if d.img1 == nil && d.img3 == nil {
+		return nil, err
+	}
+	if d.keepCoeffs {
+		if err := d.reconstructProgressiveImage(false); err != nil {
 			return nil, err
 		}
 	}
+	img, ierr := d.image()
+	if ierr != nil {
+		return nil, ierr
+	}
+	return img, &TruncatedError{Err: err}
+}
+
+// renderIntermediate reconstructs the progressive image from the scans
+// decoded so far, and passes it to the Intermediate callback. It does nothing
+// unless a multiple of IntermediateEvery scans have been decoded.
+func (d *decoder) renderIntermediate() error {
+	if every := d.opts.IntermediateEvery; every > 1 && d.nScan%every != 0 {
+		return nil
+	}
+	if err := d.reconstructProgressiveImage(true); err != nil {
+		return err
+	}
+	m, err := d.image()
+	if err != nil {
+		return err
+	}
+	d.opts.Intermediate(m)
+	return nil
+}
+
+// image returns the decoded image, converting it to the color model implied
+// by the JPEG metadata if necessary.
+func (d *decoder) image() (image.Image, error) {
+	if d.dst != nil {
+		if !d.decodesIntoDst() {
+			d.copyToDst()
+		}
+		return d.dst, nil
+	}
 	if d.img1 != nil {
-		return d.img1, nil
+		return d.img1.SubImage(d.visibleBounds()), nil
 	}
 	if d.img3 != nil {
 		if d.blackPix != nil {
@@ -711,11 +1096,20 @@ func (d *decoder) decode(r io.Reader, configOnly bool) (image.Image, error) {
 		} else if d.isRGB() {
 			return d.convertToRGB()
 		}
-		return d.img3, nil
+		return d.img3.SubImage(d.visibleBounds()), nil
 	}
 	return nil, FormatError("missing SOS marker")
 }
 
+// visibleBounds returns the part of the image bounds that the img1 or img3
+// buffer covers. That is all of it, unless a RowReader is streaming rows.
+func (d *decoder) visibleBounds() image.Rectangle {
+	if d.img1 != nil {
+		return d.bounds.Intersect(d.img1.Rect)
+	}
+	return d.bounds.Intersect(d.img3.Rect)
+}
+
 // applyBlack combines d.img3 and d.blackPix into a CMYK image. The formula
 // used depends on whether the JPEG image is stored as CMYK or YCbCrK,
 // indicated by the APP14 (Adobe) metadata.
@@ -737,12 +1131,12 @@ func (d *decoder) applyBlack() (image.Image, error) {
 		// CMY, and patch in the original K. The RGB to CMY inversion cancels
 		// out the 'Adobe inversion' described in the applyBlack doc comment
 		// above, so in practice, only the fourth channel (black) is inverted.
-		bounds := d.img3.Bounds()
+		bounds, origin := d.visibleBounds(), d.img3.Rect.Min
 		img := image.NewRGBA(bounds)
 		DrawYCbCr(img, bounds, d.img3, bounds.Min)
 		for iBase, y := 0, bounds.Min.Y; y < bounds.Max.Y; iBase, y = iBase+img.Stride, y+1 {
 			for i, x := iBase+3, bounds.Min.X; x < bounds.Max.X; i, x = i+4, x+1 {
-				img.Pix[i] = 255 - d.blackPix[(y-bounds.Min.Y)*d.blackStride+(x-bounds.Min.X)]
+				img.Pix[i] = 255 - d.blackPix[(y-origin.Y)*d.blackStride+(x-origin.X)]
 			}
 		}
 		return &image.CMYK{
@@ -757,7 +1151,7 @@ func (d *decoder) applyBlack() (image.Image, error) {
 	// []byte slice, and some channels may be subsampled. We interleave the
 	// separate channels into an image.CMYK's single []byte slice containing 4
 	// contiguous bytes per pixel.
-	bounds := d.img3.Bounds()
+	bounds, origin := d.visibleBounds(), d.img3.Rect.Min
 	img := image.NewCMYK(bounds)
 
 	translations := [4]struct {
@@ -772,12 +1166,12 @@ func (d *decoder) applyBlack() (image.Image, error) {
 	for t, translation := range translations {
 		subsample := d.comp[t].h != d.comp[0].h || d.comp[t].v != d.comp[0].v
 		for iBase, y := 0, bounds.Min.Y; y < bounds.Max.Y; iBase, y = iBase+img.Stride, y+1 {
-			sy := y - bounds.Min.Y
+			sy := y - origin.Y
 			if subsample {
 				sy /= 2
 			}
 			for i, x := iBase+t, bounds.Min.X; x < bounds.Max.X; i, x = i+4, x+1 {
-				sx := x - bounds.Min.X
+				sx := x - origin.X
 				if subsample {
 					sx /= 2
 				}
@@ -802,16 +1196,19 @@ func (d *decoder) isRGB() bool {
 
 func (d *decoder) convertToRGB() (image.Image, error) {
 	cScale := d.comp[0].h / d.comp[1].h
-	bounds := d.img3.Bounds()
+	bounds := d.visibleBounds()
 	img := image.NewRGBA(bounds)
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		po := img.PixOffset(bounds.Min.X, y)
 		yo := d.img3.YOffset(bounds.Min.X, y)
-		co := d.img3.COffset(bounds.Min.X, y)
+		// The bounds may start part way through a subsampled chroma
+		// sample, so co is offset by x0's chroma column.
+		x0 := bounds.Min.X
+		co := d.img3.COffset(x0, y) - x0/cScale
 		for i, iMax := 0, bounds.Max.X-bounds.Min.X; i < iMax; i++ {
 			img.Pix[po+4*i+0] = d.img3.Y[yo+i]
-			img.Pix[po+4*i+1] = d.img3.Cb[co+i/cScale]
-			img.Pix[po+4*i+2] = d.img3.Cr[co+i/cScale]
+			img.Pix[po+4*i+1] = d.img3.Cb[co+(x0+i)/cScale]
+			img.Pix[po+4*i+2] = d.img3.Cr[co+(x0+i)/cScale]
 			img.Pix[po+4*i+3] = 255
 		}
 	}
@@ -824,38 +1221,248 @@ func Decode(r io.Reader) (image.Image, error) {
 	return d.decode(r, false)
 }
 
+// Progress describes how far a decode has got. It is passed to the
+// [DecoderOptions] Progress callback.
+type Progress struct {
+	// Scan is the index of the current scan, starting at zero. Sequential
+	// images usually have one scan, progressive images have several.
+	Scan int
+	// MCURow is the number of MCU rows of the current scan that have been
+	// decoded, out of MCURows.
+	MCURow, MCURows int
+	// Offset is the number of bytes consumed from the input.
+	Offset int64
+}
+
+// DecoderOptions are the decoding parameters.
+type DecoderOptions struct {
+	// Progress, if non-nil, is called after each MCU row of each scan has
+	// been decoded.
+	Progress func(Progress)
+
+	// Intermediate, if non-nil, is called for progressive images with the
+	// image reconstructed from the scans decoded so far. It is called after
+	// every IntermediateEvery scans, or after every scan if IntermediateEvery
+	// is zero. Components that no scan has reached yet are rendered as mid
+	// gray. The image passed to Intermediate may be modified by later scans,
+	// so it should be copied if it needs to outlive the call.
+	Intermediate      func(image.Image)
+	IntermediateEvery int
+
+	// Partial means that if the input ends part way through the image data,
+	// the image decoded so far is returned along with a *[TruncatedError],
+	// instead of a nil image. The missing area is mid gray, apart from any
+	// progressive coefficients that did arrive.
+	Partial bool
+
+	// Resync means that corrupt image data, and missing or unexpected
+	// restart markers, are recovered from by resynchronizing at the next
+	// restart marker, like libjpeg does, instead of being an error. The
+	// skipped parts of the image are reported by a *[DamagedError] that is
+	// returned along with the image. It has no effect on images without
+	// restart markers, or that use arithmetic coding.
+	Resync bool
+
+	// Warn, if non-nil, is called for each anomaly in the input that the
+	// decoder tolerates, such as extraneous bytes between segments.
+	Warn func(Warning)
+
+	// Strict means that the anomalies reported to Warn are errors instead,
+	// apart from fill bytes, which section B.1.1.2 of the specification
+	// allows before any marker. The error is an *[Error] wrapping a
+	// *[StrictError] with the Warning.
+	Strict bool
+
+	// Scale, if 2, 4 or 8, means that the image is decoded at 1/Scale of
+	// its size, rounded up, by performing a reduced-size inverse DCT on each
+	// block. This is much faster than decoding at full size and then
+	// downsizing. Zero and 1 mean full size, and other values are invalid.
+	Scale int
+
+	// Preview means that only the DC coefficients are decoded, giving an
+	// image at 1/8 of the size, as if Scale were 8. For progressive images,
+	// decoding stops as soon as every component has had a DC scan, so the
+	// rest of the input is not read, and later DC refinement scans are
+	// missed. For sequential images, the AC coefficients are skipped over
+	// without being decoded in full.
+	Preview bool
+
+	// Crop, if non-empty, is the part of the image to decode, in the
+	// coordinates of the possibly scaled image. The returned image's bounds
+	// are Crop, intersected with the image's bounds, and it is an error if
+	// that is empty. Only the blocks that overlap Crop are reconstructed,
+	// and for sequential images with restart markers, the restart intervals
+	// that don't overlap Crop are skipped over without being decoded.
+	Crop image.Rectangle
+
+	// Tables, if not nil, is the tables from a tables-only stream, which
+	// are used by abbreviated images that lack some of their tables. Tables
+	// in the image replace them.
+	Tables *Tables
+
+	// Workers, if greater than 1, is the number of goroutines that decode
+	// concurrently. For sequential Huffman-coded images with restart
+	// markers, each restart interval is decoded independently of the
+	// others, with the whole of a scan's data being read into memory first,
+	// and Progress only being called once all of a scan's MCU rows have
+	// been decoded. For progressive images, and other images whose
+	// coefficients are kept until after the last scan, the final inverse
+	// DCTs are performed concurrently. Either way, the result is the same as
+	// without Workers.
+	Workers int
+}
+
+// A TruncatedError reports that the input ended before the image was fully
+// decoded. It is only returned when the Partial option is set, in which case
+// it accompanies the partially decoded image.
+type TruncatedError struct {
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *TruncatedError) Error() string { return "truncated JPEG image: " + e.Err.Error() }
+
+func (e *TruncatedError) Unwrap() error { return e.Err }
+
+// A DamagedError reports that parts of the image data were missing or
+// corrupt, and were skipped over by resynchronizing at restart markers. It is
+// only returned when the Resync option is set, in which case it accompanies
+// the decoded image.
+type DamagedError struct {
+	// Regions are the damaged parts of the image. For sequential images,
+	// they are mid gray. For progressive images, they only have the detail
+	// from the scans before the damage.
+	Regions []image.Rectangle
+}
+
+func (e *DamagedError) Error() string {
+	return fmt.Sprintf("damaged JPEG image: %d regions skipped", len(e.Regions))
+}
+
+// A StrictError reports an anomaly in the input that the decoder would have
+// tolerated, had the Strict option not been set. It unwraps to the
+// equivalent FormatError.
+type StrictError struct {
+	Warning Warning
+}
+
+func (e *StrictError) Error() string { return FormatError(e.Warning.String()).Error() }
+
+func (e *StrictError) Unwrap() error { return FormatError(e.Warning.String()) }
+
+// A Warning reports an anomaly in the input that the decoder tolerated.
+type Warning struct {
+	Kind WarningKind
+	// Offset is the position in the input of the first anomalous byte.
+	Offset int64
+	// Len is the number of anomalous bytes.
+	Len int64
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%v at offset %d (%d bytes)", w.Kind, w.Offset, w.Len)
+}
+
+// A WarningKind is the kind of anomaly that a Warning reports.
+type WarningKind int
+
+const (
+	// ExtraneousData is non-marker data where a marker was expected, either
+	// between segments or before a restart marker.
+	ExtraneousData WarningKind = iota + 1
+	// StuffedZero is a "\xff\x00" byte-stuffed sequence outside of scan data.
+	StuffedZero
+	// TrailingRST is a restart marker after the final entropy-coded segment
+	// of a scan.
+	TrailingRST
+	// FillBytes are 0xff bytes before a marker. They are allowed by the
+	// specification, but rarely written by encoders.
+	FillBytes
+)
+
+func (k WarningKind) String() string {
+	switch k {
+	case ExtraneousData:
+		return "extraneous data"
+	case StuffedZero:
+		return "stuffed zero byte outside scan"
+	case TrailingRST:
+		return "trailing RST marker"
+	case FillBytes:
+		return "fill bytes"
+	}
+	return fmt.Sprintf("WarningKind(%d)", int(k))
+}
+
+// DecodeContext reads a JPEG image from r and returns it as an
+// [image.Image]. It is like [Decode], except that it stops and returns
+// ctx.Err() if ctx is done before the image is fully decoded. Cancellation is
+// checked between scans and between MCU rows within a scan. Format errors are
+// returned as an *[Error], with the position in the input. Default
+// parameters are used if a nil *[DecoderOptions] is passed.
+func DecodeContext(ctx context.Context, r io.Reader, o *DecoderOptions) (image.Image, error) {
+	d := decoder{ctx: ctx}
+	if o != nil {
+		d.opts = *o
+	}
+	img, err := d.decode(r, false)
+	return img, d.wrapError(err)
+}
+
 // DecodeConfig returns the color model and dimensions of a JPEG image without
 // decoding the entire image.
 func DecodeConfig(r io.Reader) (image.Config, error) {
 	var d decoder
+	return d.decodeConfig(r)
+}
+
+// DecodeConfigContext is like [DecodeConfig], except that the dimensions
+// are those of the image that [DecodeContext] returns for the same options,
+// and format errors are returned as an *[Error]. Default parameters are used
+// if a nil *[DecoderOptions] is passed.
+func DecodeConfigContext(ctx context.Context, r io.Reader, o *DecoderOptions) (image.Config, error) {
+	d := decoder{ctx: ctx}
+	if o != nil {
+		d.opts = *o
+	}
+	cfg, err := d.decodeConfig(r)
+	return cfg, d.wrapError(err)
+}
+
+func (d *decoder) decodeConfig(r io.Reader) (image.Config, error) {
 	if _, err := d.decode(r, true); err != nil {
 		return image.Config{}, err
 	}
+	bounds, err := d.imageBounds()
+	if err != nil {
+		return image.Config{}, err
+	}
+	cm := d.colorModel()
+	if cm == nil {
+		return image.Config{}, FormatError("missing SOF marker")
+	}
+	return image.Config{
+		ColorModel: cm,
+		Width:      bounds.Dx(),
+		Height:     bounds.Dy(),
+	}, nil
+}
+
+// colorModel returns the color model of the decoded image, or nil if there
+// is no SOF segment.
+func (d *decoder) colorModel() color.Model {
 	switch d.nComp {
 	case 1:
-		return image.Config{
-			ColorModel: color.GrayModel,
-			Width:      d.width,
-			Height:     d.height,
-		}, nil
+		return color.GrayModel
 	case 3:
-		cm := color.YCbCrModel
 		if d.isRGB() {
-			cm = color.RGBAModel
+			return color.RGBAModel
 		}
-		return image.Config{
-			ColorModel: cm,
-			Width:      d.width,
-			Height:     d.height,
-		}, nil
+		return color.YCbCrModel
 	case 4:
-		return image.Config{
-			ColorModel: color.CMYKModel,
-			Width:      d.width,
-			Height:     d.height,
-		}, nil
+		return color.CMYKModel
 	}
-	return image.Config{}, FormatError("missing SOF marker")
+	return nil
 }
 
 func init() {
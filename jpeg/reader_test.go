@@ -6,13 +6,16 @@ package jpeg
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"io"
 	"math/rand"
 	"os"
+	"reflect"
 	"runtime/debug"
 	"strings"
 	"testing"
@@ -84,6 +87,38 @@ func TestDecodeProgressive(t *testing.T) {
 	}
 }
 
+// TestDecodeProgressiveRestart tests that a progressive image with restart
+// intervals, made by libjpeg, decodes to the same pixels as the sequential
+// image with the same coefficients. Its width is not a multiple of its MCU
+// width, so the restart intervals of its non-interleaved scans count fewer
+// blocks across than its MCUs have.
+func TestDecodeProgressiveRestart(t *testing.T) {
+	i0, err := decodeFile("../testdata/video-001.q50.420.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i1, err := decodeFile("../testdata/video-001.q50.420.progressive.restart.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check images are the same.
+	m0 := i0.(*image.YCbCr)
+	m1 := i1.(*image.YCbCr)
+	if m0.Bounds() != m1.Bounds() {
+		t.Fatalf("bounds differ: %v and %v", m0.Bounds(), m1.Bounds())
+	}
+	if err := check(m0.Bounds(), m0.Y, m1.Y, m0.YStride, m1.YStride); err != nil {
+		t.Errorf("Y: %v", err)
+	}
+	if err := check(m0.Bounds(), m0.Cb, m1.Cb, m0.CStride, m1.CStride); err != nil {
+		t.Errorf("Cb: %v", err)
+	}
+	if err := check(m0.Bounds(), m0.Cr, m1.Cr, m0.CStride, m1.CStride); err != nil {
+		t.Errorf("Cr: %v", err)
+	}
+}
+
 func decodeFile(filename string) (image.Image, error) {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -176,6 +211,28 @@ func check(bounds image.Rectangle, pix0, pix1 []byte, stride0, stride1 int) erro
 	return nil
 }
 
+// checkImage compares the pixels of two images within bounds.
+func checkImage(bounds image.Rectangle, m0, m1 image.Image) error {
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if c0, c1 := m0.At(x, y), m1.At(x, y); c0 != c1 {
+				return fmt.Errorf("pixel (%d, %d) differs: %v and %v", x, y, c0, c1)
+			}
+		}
+	}
+	return nil
+}
+
+// readImage reads a JPEG file and decodes it, returning both.
+func readImage(filename string) ([]byte, image.Image, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := Decode(bytes.NewReader(data))
+	return data, m, err
+}
+
 func pixString(pix []byte, stride, x, y int) string {
 	s := &strings.Builder{}
 	for j := 0; j < 8; j++ {
@@ -546,32 +603,146 @@ func TestBadRestartMarker(t *testing.T) {
 	}
 }
 
+func TestResync(t *testing.T) {
+	b, err := os.ReadFile("../testdata/video-001.restart2.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode := func(data []byte) (image.Image, error) {
+		return DecodeContext(context.Background(), bytes.NewReader(data), &DecoderOptions{Resync: true})
+	}
+
+	// The bad restart markers from TestBadRestartMarker can be recovered from.
+	prefix, suffix := b[:2816], b[2816:]
+	for _, infix := range []string{"\xff\x03", "\xff\xd5", "\xff\xff\xd5"} {
+		data := []byte(nil)
+		data = append(data, prefix...)
+		data = append(data, infix...)
+		data = append(data, suffix...)
+		m, err := decode(data)
+		if m == nil {
+			t.Errorf("%q: no image returned: %v", infix, err)
+			continue
+		}
+		var derr *DamagedError
+		if err != nil && !errors.As(err, &derr) {
+			t.Errorf("%q: got %v, want nil or a *DamagedError", infix, err)
+		}
+	}
+
+	// Insert a marker part way through the second restart interval, which
+	// covers MCU rows 2 and 3. That interval and the next are damaged, but
+	// the final interval, which covers the bottom MCU row, is intact.
+	data := []byte(nil)
+	data = append(data, b[:2000]...)
+	data = append(data, 0xff, 0xd5)
+	data = append(data, b[2000:]...)
+	if _, err := Decode(bytes.NewReader(data)); err == nil {
+		t.Fatal("Decode: got nil error, want non-nil")
+	}
+	m, err := decode(data)
+	var derr *DamagedError
+	if !errors.As(err, &derr) {
+		t.Fatalf("got %v, want a *DamagedError", err)
+	}
+	bottom := image.Rect(0, 96, 150, 103)
+	for _, r := range derr.Regions {
+		if r.Overlaps(bottom) {
+			t.Errorf("damaged region %v overlaps the bottom MCU row", r)
+		}
+	}
+	if r := derr.Regions[0]; r.Min.Y != 32 || r.Max.X != 150 {
+		t.Errorf("damaged regions %v do not start in MCU row 2", derr.Regions)
+	}
+	if err := checkImage(bottom, clean, m); err != nil {
+		t.Fatal(err)
+	}
+
+	// The Partial option doesn't change that, as the data isn't truncated.
+	opts := &DecoderOptions{Resync: true, Partial: true}
+	m2, err2 := DecodeContext(context.Background(), bytes.NewReader(data), opts)
+	if m2 == nil || err2 == nil || err2.Error() != err.Error() {
+		t.Fatalf("with Partial: got %v, %v, want an image and %v", m2, err2, err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Error("with Partial: images differ")
+	}
+}
+
 func TestArithmetic(t *testing.T) {
 	// Reference image.
 	i0, err := decodeFile("../testdata/video-001.jpeg")
 	if err != nil {
 		t.Fatal(err)
 	}
+	m0 := i0.(*image.YCbCr)
+
+	// These have the same coefficients as the reference image, so they
+	// decode to the same pixels. The second has restart intervals, and the
+	// third is progressive, with successive approximation, and has restart
+	// intervals.
+	testCases := []string{
+		"../testdata/video-001.arithmetic.jpeg",
+		"../testdata/video-001.arithmetic.restart.jpeg",
+		"../testdata/video-001.arithmetic.progressive.jpeg",
+	}
+	for _, tc := range testCases {
+		i1, err := decodeFile(tc)
+		if err != nil {
+			t.Errorf("%s: %v", tc, err)
+			continue
+		}
+
+		// Check images are the same.
+		m1 := i1.(*image.YCbCr)
+		if m0.Bounds() != m1.Bounds() {
+			t.Errorf("%s: bounds differ: %v and %v", tc, m0.Bounds(), m1.Bounds())
+			continue
+		}
+		if err := check(m0.Bounds(), m0.Y, m1.Y, m0.YStride, m1.YStride); err != nil {
+			t.Errorf("%s (Y): %v", tc, err)
+		}
+		if err := check(m0.Bounds(), m0.Cb, m1.Cb, m0.CStride, m1.CStride); err != nil {
+			t.Errorf("%s (Cb): %v", tc, err)
+		}
+		if err := check(m0.Bounds(), m0.Cr, m1.Cr, m0.CStride, m1.CStride); err != nil {
+			t.Errorf("%s (Cr): %v", tc, err)
+		}
+	}
+}
 
-	i1, err := decodeFile("../testdata/video-001.arithmetic.jpeg")
+// TestHuffmanCorrupt tests that corrupt Huffman-coded data, which here codes
+// a run of zero coefficients past the end of a block, is an error rather than
+// a panic.
+func TestHuffmanCorrupt(t *testing.T) {
+	data, err := os.ReadFile("../testdata/video-001.corrupt.jpeg")
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Check images are the same.
-	m0 := i0.(*image.YCbCr)
-	m1 := i1.(*image.YCbCr)
-	if m0.Bounds() != m1.Bounds() {
-		t.Errorf("bounds differ: %v and %v", m0.Bounds(), m1.Bounds())
+	want := FormatError("too many coefficients")
+	if _, err := Decode(bytes.NewReader(data)); err != want {
+		t.Errorf("Decode: got %v, want %v", err, want)
 	}
-	if err := check(m0.Bounds(), m0.Y, m1.Y, m0.YStride, m1.YStride); err != nil {
-		t.Errorf("arithmetic (Y): %v", err)
+}
+
+// TestArithmeticCorrupt tests that corrupt arithmetic-coded data, which here
+// codes a run of zero coefficients past the end of a block, is an error
+// rather than a panic.
+func TestArithmeticCorrupt(t *testing.T) {
+	data, err := os.ReadFile("../testdata/video-001.arithmetic.corrupt.jpeg")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err := check(m0.Bounds(), m0.Cb, m1.Cb, m0.CStride, m1.CStride); err != nil {
-		t.Errorf("arithmetic (Cb): %v", err)
+	want := FormatError("too many coefficients")
+	if _, err := Decode(bytes.NewReader(data)); err != want {
+		t.Errorf("Decode: got %v, want %v", err, want)
 	}
-	if err := check(m0.Bounds(), m0.Cr, m1.Cr, m0.CStride, m1.CStride); err != nil {
-		t.Errorf("arithmetic (Cr): %v", err)
+	if _, err := DecodeCoefficients(context.Background(), bytes.NewReader(data), nil); !errors.Is(err, want) {
+		t.Errorf("DecodeCoefficients: got %v, want %v", err, want)
 	}
 }
 
@@ -592,6 +763,164 @@ func TestLossless(t *testing.T) {
 	}
 }
 
+func TestDecodeContext(t *testing.T) {
+	data, err := os.ReadFile("../testdata/video-001.progressive.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that progress is reported for every MCU row of every scan.
+	var progress []Progress
+	m, err := DecodeContext(context.Background(), bytes.NewReader(data), &DecoderOptions{
+		Progress: func(p Progress) {
+			progress = append(progress, p)
+		},
+	})
+	if err != nil {
+		t.Fatalf("DecodeContext: %v", err)
+	}
+	if m.Bounds() != image.Rect(0, 0, 150, 103) {
+		t.Errorf("bad bounds: %v", m.Bounds())
+	}
+	if len(progress) == 0 {
+		t.Fatal("no progress reported")
+	}
+	for i, p := range progress[1:] {
+		prev := progress[i]
+		if p.Offset < prev.Offset {
+			t.Errorf("progress %d: offset went backwards from %d to %d", i+1, prev.Offset, p.Offset)
+		}
+		if p.Scan == prev.Scan && p.MCURow != prev.MCURow+1 {
+			t.Errorf("progress %d: MCU row went from %d to %d", i+1, prev.MCURow, p.MCURow)
+		}
+	}
+	last := progress[len(progress)-1]
+	if last.Scan == 0 {
+		t.Errorf("progressive image reported only one scan")
+	}
+	if last.MCURow != last.MCURows {
+		t.Errorf("last progress has MCU row %d of %d", last.MCURow, last.MCURows)
+	}
+	if last.Offset <= 0 || last.Offset > int64(len(data)) {
+		t.Errorf("last progress has offset %d, want in (0, %d]", last.Offset, len(data))
+	}
+
+	// Check that canceling part way through stops the decode.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = DecodeContext(ctx, bytes.NewReader(data), &DecoderOptions{
+		Progress: func(p Progress) {
+			if p.Scan == 1 {
+				cancel()
+			}
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDecodeIntermediate(t *testing.T) {
+	data, err := os.ReadFile("../testdata/video-001.progressive.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m0 := want.(*image.YCbCr)
+
+	nScans := 0
+	var last *image.YCbCr
+	_, err = DecodeContext(context.Background(), bytes.NewReader(data), &DecoderOptions{
+		Progress: func(p Progress) {
+			nScans = p.Scan + 1
+		},
+		Intermediate: func(m image.Image) {
+			m1 := *m.(*image.YCbCr)
+			m1.Y = bytes.Clone(m1.Y)
+			m1.Cb = bytes.Clone(m1.Cb)
+			m1.Cr = bytes.Clone(m1.Cr)
+			last = &m1
+		},
+	})
+	if err != nil {
+		t.Fatalf("DecodeContext: %v", err)
+	}
+	if last == nil {
+		t.Fatal("Intermediate was not called")
+	}
+	// The image rendered after the final scan should match the decoded image.
+	if err := check(m0.Bounds(), m0.Y, last.Y, m0.YStride, last.YStride); err != nil {
+		t.Errorf("Y: %v", err)
+	}
+	if err := check(m0.Bounds(), m0.Cb, last.Cb, m0.CStride, last.CStride); err != nil {
+		t.Errorf("Cb: %v", err)
+	}
+	if err := check(m0.Bounds(), m0.Cr, last.Cr, m0.CStride, last.CStride); err != nil {
+		t.Errorf("Cr: %v", err)
+	}
+
+	// Check that IntermediateEvery reduces the number of calls.
+	nCalls := 0
+	_, err = DecodeContext(context.Background(), bytes.NewReader(data), &DecoderOptions{
+		Intermediate: func(m image.Image) {
+			nCalls++
+		},
+		IntermediateEvery: 2,
+	})
+	if err != nil {
+		t.Fatalf("DecodeContext: %v", err)
+	}
+	if want := nScans / 2; nCalls != want {
+		t.Errorf("got %d calls for %d scans, want %d", nCalls, nScans, want)
+	}
+}
+
+func TestDecodePartial(t *testing.T) {
+	// Without the Partial option, truncated images are an error.
+	data, err := os.ReadFile("../testdata/video-001.progressive.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = data[:len(data)*3/5]
+	if _, err := Decode(bytes.NewReader(data)); err == nil {
+		t.Fatal("Decode: got nil error, want non-nil")
+	}
+	m, err := DecodeContext(context.Background(), bytes.NewReader(data), &DecoderOptions{Partial: true})
+	var terr *TruncatedError
+	if !errors.As(err, &terr) {
+		t.Fatalf("got %v, want a *TruncatedError", err)
+	}
+	if m == nil || m.Bounds() != image.Rect(0, 0, 150, 103) {
+		t.Fatalf("got image %v, want a 150x103 image", m)
+	}
+
+	// Truncate a sequential image part way through its image data. The top
+	// should match the full image and the bottom should be mid gray.
+	data, err = os.ReadFile("../testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sos := bytes.Index(data, []byte{0xff, sosMarker})
+	m, err = DecodeContext(context.Background(), bytes.NewReader(data[:sos+(len(data)-sos)/2]), &DecoderOptions{Partial: true})
+	if !errors.As(err, &terr) {
+		t.Fatalf("got %v, want a *TruncatedError", err)
+	}
+	m0, m1 := full.(*image.YCbCr), m.(*image.YCbCr)
+	if err := check(image.Rect(0, 0, 150, 16), m0.Y, m1.Y, m0.YStride, m1.YStride); err != nil {
+		t.Errorf("top: %v", err)
+	}
+	if got := m1.YCbCrAt(149, 102); got != (color.YCbCr{0x80, 0x80, 0x80}) {
+		t.Errorf("bottom right: got %v, want mid gray", got)
+	}
+}
+
 func benchmarkDecode(b *testing.B, filename string) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -616,3 +945,877 @@ func BenchmarkDecodeBaseline(b *testing.B) {
 func BenchmarkDecodeProgressive(b *testing.B) {
 	benchmarkDecode(b, "../testdata/video-001.progressive.jpeg")
 }
+
+func BenchmarkDecodeProgressiveWorkers(b *testing.B) {
+	data, err := os.ReadFile("../testdata/video-001.progressive.jpeg")
+	if err != nil {
+		b.Fatal(err)
+	}
+	cfg, err := DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(cfg.Width * cfg.Height * 4))
+	b.ReportAllocs()
+	b.ResetTimer()
+	o := &DecoderOptions{Workers: 4}
+	for i := 0; i < b.N; i++ {
+		DecodeContext(context.Background(), bytes.NewReader(data), o)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	b, err := os.ReadFile("../testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(at int, s string) []byte {
+		data := append([]byte(nil), b[:at]...)
+		data = append(data, s...)
+		return append(data, b[at:]...)
+	}
+	eoi := len(b) - 2
+	testCases := []struct {
+		data   []byte
+		want   []Warning
+		strict bool
+	}{
+		{b, nil, false},
+		{insert(2, "abc"), []Warning{{ExtraneousData, 2, 3}}, true},
+		{insert(2, "\xff\x00"), []Warning{{StuffedZero, 2, 2}}, true},
+		{insert(2, "\xff\xff"), []Warning{{FillBytes, 2, 2}}, false},
+		{insert(eoi, "\xff\xd0"), []Warning{{TrailingRST, int64(eoi), 2}}, true},
+		{insert(eoi, "\x01\x02\xff\xd0\x03"), []Warning{
+			{ExtraneousData, int64(eoi), 2},
+			{TrailingRST, int64(eoi) + 2, 2},
+			{ExtraneousData, int64(eoi) + 4, 1},
+		}, true},
+	}
+	for i, tc := range testCases {
+		var got []Warning
+		o := &DecoderOptions{Warn: func(w Warning) { got = append(got, w) }}
+		if _, err := DecodeContext(context.Background(), bytes.NewReader(tc.data), o); err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("#%d: got warnings %v, want %v", i, got, tc.want)
+		}
+
+		o = &DecoderOptions{Strict: true}
+		_, err := DecodeContext(context.Background(), bytes.NewReader(tc.data), o)
+		if gotStrict := err != nil; gotStrict != tc.strict {
+			t.Errorf("#%d: strict: got error %v, want error %t", i, err, tc.strict)
+		}
+		if !tc.strict {
+			continue
+		}
+		var serr *StrictError
+		if !errors.As(err, &serr) {
+			t.Errorf("#%d: strict: got %v, want a *StrictError", i, err)
+		} else if serr.Warning != tc.want[0] {
+			t.Errorf("#%d: strict: got warning %v, want %v", i, serr.Warning, tc.want[0])
+		}
+		var ferr FormatError
+		if !errors.As(err, &ferr) {
+			t.Errorf("#%d: strict: got %v, want a FormatError", i, err)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	b, err := os.ReadFile("../testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The DQT segment at offset 20 starts with its Pq/Tq byte at offset 24.
+	data := append([]byte(nil), b...)
+	data[24] = 0x05
+	_, err = DecodeContext(context.Background(), bytes.NewReader(data), nil)
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("got %v, want an *Error", err)
+	}
+	if !errors.Is(err, FormatError("bad Tq value")) {
+		t.Errorf("got %v, want a bad Tq value FormatError", err)
+	}
+	if e.Marker != dqtMarker || e.Offset != 25 {
+		t.Errorf("got marker %#x at offset %d, want %#x at offset 25", e.Marker, e.Offset, dqtMarker)
+	}
+	if got, want := e.Error(), "invalid JPEG format: bad Tq value at offset 25 in DQT segment"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Decode returns the bare FormatError, for compatibility.
+	if _, err := Decode(bytes.NewReader(data)); err != FormatError("bad Tq value") {
+		t.Errorf("Decode: got %v, want a bad Tq value FormatError", err)
+	}
+
+	// A bad restart marker at the end of the second restart interval, after
+	// the 40th MCU.
+	b, err = os.ReadFile("../testdata/video-001.restart2.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = nil
+	data = append(data, b[:2816]...)
+	data = append(data, "\xff\xd5"...)
+	data = append(data, b[2816:]...)
+	_, err = DecodeContext(context.Background(), bytes.NewReader(data), nil)
+	if !errors.As(err, &e) {
+		t.Fatalf("got %v, want an *Error", err)
+	}
+	if e.Marker != sosMarker || e.Scan != 0 || e.MCU != image.Pt(9, 3) {
+		t.Errorf("got marker %#x, scan %d, MCU %v, want %#x, 0, (9,3)", e.Marker, e.Scan, e.MCU, sosMarker)
+	}
+}
+
+// planeDelta returns the average difference between the samples of a plane
+// of a scaled image, and the averages of the corresponding factor×factor
+// squares of samples of the full-size plane.
+func planeDelta(scaled []byte, stride int, full []byte, fullStride, factor int) int {
+	sum, n := 0, 0
+	for y := 0; y < len(scaled)/stride; y++ {
+		for x := 0; x < stride; x++ {
+			avg := 0
+			for j := 0; j < factor; j++ {
+				for i := 0; i < factor; i++ {
+					avg += int(full[(factor*y+j)*fullStride+factor*x+i])
+				}
+			}
+			avg = (avg + factor*factor/2) / (factor * factor)
+			sum += max(avg-int(scaled[y*stride+x]), int(scaled[y*stride+x])-avg)
+			n++
+		}
+	}
+	return sum / n
+}
+
+func TestDecodeScaled(t *testing.T) {
+	for _, filename := range []string{
+		"../testdata/video-001.jpeg",
+		"../testdata/video-001.progressive.jpeg",
+		"../testdata/video-001.q50.410.jpeg",
+		"../testdata/video-001.q50.444.progressive.jpeg",
+		"../testdata/video-005.gray.q50.2x2.jpeg",
+		"../testdata/video-005.gray.q50.progressive.jpeg",
+	} {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		full, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", filename, err)
+		}
+		for _, scale := range []int{2, 4, 8} {
+			o := &DecoderOptions{Scale: scale}
+			m, err := DecodeContext(context.Background(), bytes.NewReader(data), o)
+			if err != nil {
+				t.Errorf("%s, scale %d: %v", filename, scale, err)
+				continue
+			}
+			b := full.Bounds()
+			want := image.Rect(0, 0, (b.Dx()+scale-1)/scale, (b.Dy()+scale-1)/scale)
+			if got := m.Bounds(); got != want {
+				t.Errorf("%s, scale %d: got bounds %v, want %v", filename, scale, got, want)
+				continue
+			}
+			cfg, err := DecodeConfigContext(context.Background(), bytes.NewReader(data), o)
+			if err != nil {
+				t.Errorf("%s, scale %d: DecodeConfigContext: %v", filename, scale, err)
+			} else if cfg.Width != want.Dx() || cfg.Height != want.Dy() {
+				t.Errorf("%s, scale %d: DecodeConfigContext: got %dx%d, want %v", filename, scale, cfg.Width, cfg.Height, want.Size())
+			}
+
+			// Truncating the DCT is not quite the same as averaging, but
+			// should be close. The underlying planes extend to whole MCUs, so
+			// they can be compared even when the image size isn't a multiple
+			// of scale.
+			var deltas []int
+			switch m := m.(type) {
+			case *image.Gray:
+				f := full.(*image.Gray)
+				deltas = append(deltas, planeDelta(m.Pix, m.Stride, f.Pix, f.Stride, scale))
+			case *image.YCbCr:
+				f := full.(*image.YCbCr)
+				deltas = append(deltas,
+					planeDelta(m.Y, m.YStride, f.Y, f.YStride, scale),
+					planeDelta(m.Cb, m.CStride, f.Cb, f.CStride, scale),
+					planeDelta(m.Cr, m.CStride, f.Cr, f.CStride, scale),
+				)
+			}
+			for _, d := range deltas {
+				if d > 4 {
+					t.Errorf("%s, scale %d: average delta is too high: %v", filename, scale, deltas)
+					break
+				}
+			}
+		}
+	}
+
+	if _, err := DecodeContext(context.Background(), strings.NewReader(""), &DecoderOptions{Scale: 3}); err == nil {
+		t.Error("scale 3: got nil error, want non-nil")
+	}
+}
+
+func TestDecodePreview(t *testing.T) {
+	for _, filename := range []string{
+		"../testdata/video-001.jpeg",
+		"../testdata/video-001.arithmetic.jpeg",
+		"../testdata/video-001.progressive.jpeg",
+		"../testdata/video-001.restart2.jpeg",
+		"../testdata/video-001.separate.dc.progression.jpeg",
+		"../testdata/video-001.separate.dc.progression.progressive.jpeg",
+		"../testdata/video-005.gray.q50.progressive.jpeg",
+	} {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scaled, err := DecodeContext(context.Background(), bytes.NewReader(data), &DecoderOptions{Scale: 8})
+		if err != nil {
+			t.Fatalf("%s: %v", filename, err)
+		}
+		progressive := strings.HasSuffix(filename, "progressive.jpeg")
+		if progressive {
+			// The DC scans come first, so the rest of the input is not
+			// needed.
+			data = data[:len(data)/2]
+		}
+		m, err := DecodeContext(context.Background(), bytes.NewReader(data), &DecoderOptions{Preview: true})
+		if err != nil {
+			t.Errorf("%s: %v", filename, err)
+			continue
+		}
+		if m.Bounds() != scaled.Bounds() {
+			t.Errorf("%s: got bounds %v, want %v", filename, m.Bounds(), scaled.Bounds())
+			continue
+		}
+		// Sequential previews are exact. Progressive previews can miss the
+		// low bits of the DC coefficients.
+		if d := averageDelta(m, scaled); d != 0 && (!progressive || d > 2<<8) {
+			t.Errorf("%s: average delta is too high (%d)", filename, d>>8)
+		}
+	}
+}
+
+func TestDecodeCrop(t *testing.T) {
+	crops := []image.Rectangle{
+		image.Rect(0, 0, 150, 103),
+		image.Rect(13, 7, 97, 61),
+		image.Rect(100, 90, 150, 103),
+		image.Rect(-10, 50, 20, 200),
+	}
+	for _, filename := range []string{
+		"../testdata/video-001.jpeg",
+		"../testdata/video-001.progressive.jpeg",
+		"../testdata/video-001.restart2.jpeg",
+		"../testdata/video-001.q50.410.jpeg",
+		"../testdata/video-001.cmyk.jpeg",
+		"../testdata/video-001.rgb.jpeg",
+		"../testdata/video-005.gray.q50.2x2.jpeg",
+	} {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, scale := range []int{1, 2} {
+			o := &DecoderOptions{Scale: scale}
+			full, err := DecodeContext(context.Background(), bytes.NewReader(data), o)
+			if err != nil {
+				t.Fatalf("%s: %v", filename, err)
+			}
+			for _, crop := range crops {
+				crop = image.Rect(crop.Min.X/scale, crop.Min.Y/scale, crop.Max.X/scale, crop.Max.Y/scale)
+				o.Crop = crop
+				m, err := DecodeContext(context.Background(), bytes.NewReader(data), o)
+				if err != nil {
+					t.Errorf("%s, scale %d, crop %v: %v", filename, scale, crop, err)
+					continue
+				}
+				want := crop.Intersect(full.Bounds())
+				if m.Bounds() != want {
+					t.Errorf("%s, scale %d, crop %v: got bounds %v, want %v", filename, scale, crop, m.Bounds(), want)
+					continue
+				}
+				cfg, err := DecodeConfigContext(context.Background(), bytes.NewReader(data), o)
+				if err != nil || cfg.Width != want.Dx() || cfg.Height != want.Dy() {
+					t.Errorf("%s, scale %d, crop %v: DecodeConfigContext: got %dx%d, %v", filename, scale, crop, cfg.Width, cfg.Height, err)
+				}
+				if err := checkImage(want, full, m); err != nil {
+					t.Errorf("%s, scale %d, crop %v: %v", filename, scale, crop, err)
+				}
+			}
+		}
+	}
+
+	// Restart intervals outside the crop are not decoded. Corrupt the second
+	// of the four intervals, which covers MCU rows 2 and 3, by replacing it
+	// with all one bits, which is not a valid Huffman code.
+	data, err := os.ReadFile("../testdata/video-001.restart2.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1480; i < 2816; i += 2 {
+		data[i], data[i+1] = 0xff, 0x00
+	}
+	if _, err := Decode(bytes.NewReader(data)); err == nil {
+		t.Fatal("Decode: got nil error, want non-nil")
+	}
+	crop := image.Rect(20, 70, 130, 103)
+	m, err := DecodeContext(context.Background(), bytes.NewReader(data), &DecoderOptions{Crop: crop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.(*image.YCbCr), clean.(*image.YCbCr).SubImage(crop).(*image.YCbCr); averageDelta(got, want) != 0 {
+		t.Error("cropped image differs")
+	}
+
+	if _, err := DecodeContext(context.Background(), bytes.NewReader(data), &DecoderOptions{Crop: image.Rect(200, 0, 300, 10)}); err == nil {
+		t.Error("crop outside the image: got nil error, want non-nil")
+	}
+}
+
+func TestRowReader(t *testing.T) {
+	for _, filename := range []string{
+		"../testdata/video-001.jpeg",
+		"../testdata/video-001.progressive.jpeg",
+		"../testdata/video-001.restart2.jpeg",
+		"../testdata/video-001.arithmetic.jpeg",
+		"../testdata/video-001.q50.410.jpeg",
+		"../testdata/video-001.cmyk.jpeg",
+		"../testdata/video-001.rgb.jpeg",
+		"../testdata/video-001.separate.dc.progression.jpeg",
+		"../testdata/video-005.gray.q50.2x2.jpeg",
+	} {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range []DecoderOptions{
+			{},
+			{Scale: 4},
+			{Crop: image.Rect(13, 20, 97, 61)},
+			{Preview: true},
+		} {
+			want, err := DecodeContext(context.Background(), bytes.NewReader(data), &o)
+			if err != nil {
+				t.Fatalf("%s, %+v: %v", filename, o, err)
+			}
+			rr, err := NewRowReader(bytes.NewReader(data), &o)
+			if err != nil {
+				t.Errorf("%s, %+v: NewRowReader: %v", filename, o, err)
+				continue
+			}
+			if rr.Bounds() != want.Bounds() {
+				t.Errorf("%s, %+v: got bounds %v, want %v", filename, o, rr.Bounds(), want.Bounds())
+				continue
+			}
+			if err := checkRows(rr, want); err != nil {
+				t.Errorf("%s, %+v: %v", filename, o, err)
+			}
+		}
+	}
+}
+
+// checkRows checks that the strips read from rr cover want's bounds, in
+// order, and match its pixels.
+func checkRows(rr *RowReader, want image.Image) error {
+	y := want.Bounds().Min.Y
+	for {
+		m, err := rr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		b := m.Bounds()
+		if b.Min.Y != y || b.Min.X != want.Bounds().Min.X || b.Max.X != want.Bounds().Max.X {
+			return fmt.Errorf("strip has bounds %v, want it to start at row %d", b, y)
+		}
+		if m, ok := m.(*image.YCbCr); ok && len(m.Y) > m.YStride*16 {
+			return fmt.Errorf("strip %v has a %d byte Y plane", b, len(m.Y))
+		}
+		for ; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if c0, c1 := want.At(x, y), m.At(x, y); c0 != c1 {
+					return fmt.Errorf("pixel (%d, %d) differs: %v and %v", x, y, c0, c1)
+				}
+			}
+		}
+	}
+	if y != want.Bounds().Max.Y {
+		return fmt.Errorf("strips ended at row %d, want %d", y, want.Bounds().Max.Y)
+	}
+	return nil
+}
+
+func TestDecodeWorkers(t *testing.T) {
+	b, err := os.ReadFile("../testdata/video-001.restart2.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// garbled has corrupt data, but no markers, part way through the second
+	// restart interval. marked has an unexpected marker there instead.
+	garbled := bytes.Clone(b)
+	for i := 2000; i < 2100; i++ {
+		garbled[i] = 0xfe
+	}
+	marked := append(append(bytes.Clone(b[:2000]), 0xff, 0xd5), b[2000:]...)
+	testCases := []struct {
+		desc string
+		data []byte
+		o    DecoderOptions
+	}{
+		{"clean", b, DecoderOptions{}},
+		{"scaled", b, DecoderOptions{Scale: 2}},
+		{"preview", b, DecoderOptions{Preview: true}},
+		{"cropped", b, DecoderOptions{Crop: image.Rect(20, 40, 60, 70)}},
+		{"garbled", garbled, DecoderOptions{}},
+		{"garbled resync", garbled, DecoderOptions{Resync: true}},
+		{"marked", marked, DecoderOptions{}},
+		{"marked resync", marked, DecoderOptions{Resync: true}},
+		{"truncated", b[:3000], DecoderOptions{}},
+		{"truncated partial", b[:3000], DecoderOptions{Partial: true}},
+	}
+	for _, tc := range testCases {
+		var rows0, rows1 int
+		o := tc.o
+		o.Progress = func(Progress) { rows0++ }
+		want, wantErr := DecodeContext(context.Background(), bytes.NewReader(tc.data), &o)
+		o.Progress = func(Progress) { rows1++ }
+		o.Workers = 4
+		got, gotErr := DecodeContext(context.Background(), bytes.NewReader(tc.data), &o)
+		if fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+			t.Errorf("%s: got error %v, want %v", tc.desc, gotErr, wantErr)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: images differ", tc.desc)
+		}
+		if rows1 != rows0 {
+			t.Errorf("%s: got %d Progress calls, want %d", tc.desc, rows1, rows0)
+		}
+	}
+}
+
+func TestDecodeProgressiveWorkers(t *testing.T) {
+	for _, filename := range []string{
+		"../testdata/video-001.progressive.jpeg",
+		"../testdata/video-001.q50.410.progressive.jpeg",
+		"../testdata/video-001.separate.dc.progression.jpeg",
+		"../testdata/video-005.gray.q50.2x2.progressive.jpeg",
+	} {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range []DecoderOptions{
+			{},
+			{Scale: 2},
+			{Crop: image.Rect(13, 20, 97, 61)},
+		} {
+			var intermediates [2][][]byte
+			decode := func(workers int) (image.Image, error) {
+				o := o
+				o.Workers = workers
+				o.Intermediate = func(m image.Image) {
+					var pix []byte
+					switch m := m.(type) {
+					case *image.Gray:
+						pix = bytes.Clone(m.Pix)
+					case *image.YCbCr:
+						pix = bytes.Join([][]byte{m.Y, m.Cb, m.Cr}, nil)
+					}
+					intermediates[min(workers, 1)] = append(intermediates[min(workers, 1)], pix)
+				}
+				return DecodeContext(context.Background(), bytes.NewReader(data), &o)
+			}
+			want, err := decode(0)
+			if err != nil {
+				t.Fatalf("%s, %+v: %v", filename, o, err)
+			}
+			got, err := decode(4)
+			if err != nil {
+				t.Fatalf("%s, %+v: Workers: %v", filename, o, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s, %+v: images differ", filename, o)
+			}
+			if !reflect.DeepEqual(intermediates[1], intermediates[0]) {
+				t.Errorf("%s, %+v: intermediate images differ", filename, o)
+			}
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	dec := NewDecoder(nil)
+	// Decode images of different kinds in turn, so that the buffers left
+	// over from one don't match the next.
+	for _, filename := range []string{
+		"../testdata/video-001.progressive.jpeg",
+		"../testdata/video-001.jpeg",
+		"../testdata/video-001.progressive.jpeg",
+		"../testdata/video-001.q50.410.jpeg",
+		"../testdata/video-005.gray.q50.progressive.jpeg",
+		"../testdata/video-005.gray.q50.jpeg",
+		"../testdata/video-001.cmyk.jpeg",
+		"../testdata/video-001.cmyk.jpeg",
+		"../testdata/video-001.restart2.jpeg",
+	} {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range []*DecoderOptions{nil, {Scale: 2}} {
+			want, err := DecodeContext(context.Background(), bytes.NewReader(data), o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec.Reset(o)
+			got, err := dec.Decode(context.Background(), bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%s: Decode: %v", filename, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s, %+v: Decode: images differ", filename, o)
+			}
+
+			// The image, whose size is not a multiple of its MCU size, is
+			// copied to dst, and to sub, which is part of a larger canvas
+			// whose other pixels are not written.
+			b := want.Bounds()
+			r := image.Rect(b.Min.X, b.Min.Y, b.Max.X+32, b.Max.Y+32)
+			var dst, sub image.Image
+			var canvas []byte
+			var canvasOffset func(x, y int) int
+			switch want := want.(type) {
+			case *image.Gray:
+				m := image.NewGray(r)
+				dst, sub, canvas, canvasOffset = image.NewGray(b), m.SubImage(b), m.Pix, m.PixOffset
+			case *image.YCbCr:
+				m := image.NewYCbCr(r, want.SubsampleRatio)
+				dst, sub, canvas, canvasOffset = image.NewYCbCr(b, want.SubsampleRatio), m.SubImage(b), m.Y, m.YOffset
+			default:
+				if err := dec.DecodeInto(context.Background(), bytes.NewReader(data), image.NewYCbCr(want.Bounds(), image.YCbCrSubsampleRatio444)); err == nil {
+					t.Errorf("%s: DecodeInto: got nil error for a %T image", filename, want)
+				}
+				continue
+			}
+			for i := range canvas {
+				canvas[i] = 0x5a
+			}
+			for _, dst := range []image.Image{dst, sub} {
+				if err := dec.DecodeInto(context.Background(), bytes.NewReader(data), dst); err != nil {
+					t.Fatalf("%s: DecodeInto: %v", filename, err)
+				}
+				if dec.d.decodesIntoDst() {
+					t.Errorf("%s, %+v: DecodeInto: decoded straight into a %v image", filename, o, dst.Bounds())
+				}
+				for y := b.Min.Y; y < b.Max.Y; y++ {
+					for x := b.Min.X; x < b.Max.X; x++ {
+						if c0, c1 := want.At(x, y), dst.At(x, y); c0 != c1 {
+							t.Fatalf("%s, %+v: DecodeInto: pixel (%d, %d) differs: %v and %v", filename, o, x, y, c0, c1)
+						}
+					}
+				}
+			}
+			if err := checkOutside(canvas, canvasOffset, r, b, 0x5a); err != nil {
+				t.Errorf("%s, %+v: DecodeInto: %v", filename, o, err)
+			}
+		}
+	}
+
+	data, err := os.ReadFile("../testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ratio := m.(*image.YCbCr).SubsampleRatio
+	dst := image.NewYCbCr(image.Rect(0, 0, 150, 103), ratio)
+	for _, m := range []image.Image{
+		image.NewYCbCr(image.Rect(0, 0, 150, 104), ratio),
+		image.NewYCbCr(image.Rect(0, 0, 150, 103), ratio+1),
+		image.NewGray(image.Rect(0, 0, 150, 103)),
+	} {
+		if err := dec.DecodeInto(context.Background(), bytes.NewReader(data), m); err == nil {
+			t.Errorf("DecodeInto: got nil error for a mismatched %T with bounds %v", m, m.Bounds())
+		}
+	}
+
+	// Decoding the same size of image into the same destination doesn't
+	// allocate.
+	dec.Reset(nil)
+	r := bytes.NewReader(data)
+	allocs := testing.AllocsPerRun(10, func() {
+		r.Reset(data)
+		if err := dec.DecodeInto(context.Background(), r, dst); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("DecodeInto made %v allocations, want 0", allocs)
+	}
+
+	// An image whose size is a multiple of its MCU size is decoded straight
+	// into dst, or into sub, which is part of a larger canvas whose other
+	// pixels are not written. That doesn't allocate either, and the Decoder
+	// doesn't keep dst's buffers for other images.
+	src := image.NewRGBA(image.Rect(0, 0, 160, 112))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * 7)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	data = buf.Bytes()
+	m, err = Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := m.(*image.YCbCr)
+	canvas := image.NewYCbCr(image.Rect(0, 0, 224, 160), want.SubsampleRatio)
+	for _, p := range [][]byte{canvas.Y, canvas.Cb, canvas.Cr} {
+		for i := range p {
+			p[i] = 0x5a
+		}
+	}
+	sub := canvas.SubImage(want.Rect).(*image.YCbCr)
+	for _, dst := range []*image.YCbCr{image.NewYCbCr(want.Rect, want.SubsampleRatio), sub} {
+		allocs := testing.AllocsPerRun(10, func() {
+			r.Reset(data)
+			if err := dec.DecodeInto(context.Background(), r, dst); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("DecodeInto made %v allocations decoding straight into dst, want 0", allocs)
+		}
+		if !dec.d.decodesIntoDst() {
+			t.Errorf("DecodeInto: copied to a %v image with stride %d", dst.Rect, dst.YStride)
+		}
+		if err := check(want.Rect, want.Y, dst.Y, want.YStride, dst.YStride); err != nil {
+			t.Errorf("DecodeInto (Y): %v", err)
+		}
+		if err := check(want.Rect, want.Cb, dst.Cb, want.CStride, dst.CStride); err != nil {
+			t.Errorf("DecodeInto (Cb): %v", err)
+		}
+		if err := check(want.Rect, want.Cr, dst.Cr, want.CStride, dst.CStride); err != nil {
+			t.Errorf("DecodeInto (Cr): %v", err)
+		}
+	}
+	if err := checkOutside(canvas.Y, canvas.YOffset, canvas.Rect, want.Rect, 0x5a); err != nil {
+		t.Errorf("DecodeInto (Y): %v", err)
+	}
+	// The image size is a multiple of the chroma subsampling, so no chroma
+	// samples are shared with the canvas.
+	if err := checkOutside(canvas.Cb, canvas.COffset, canvas.Rect, want.Rect, 0x5a); err != nil {
+		t.Errorf("DecodeInto (Cb): %v", err)
+	}
+	if err := checkOutside(canvas.Cr, canvas.COffset, canvas.Rect, want.Rect, 0x5a); err != nil {
+		t.Errorf("DecodeInto (Cr): %v", err)
+	}
+	got, err := dec.Decode(context.Background(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &got.(*image.YCbCr).Y[0] == &sub.Y[0] {
+		t.Error("Decode: image shares its pixels with a previous DecodeInto destination")
+	}
+}
+
+// checkOutside checks that the samples of pix for the pixels in r but
+// outside of b are v, where offset returns the offset of a pixel's sample.
+func checkOutside(pix []byte, offset func(x, y int) int, r, b image.Rectangle, v byte) error {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if (image.Point{x, y}).In(b) {
+				continue
+			}
+			if got := pix[offset(x, y)]; got != v {
+				return fmt.Errorf("sample for pixel (%d, %d) outside of %v was written: got %#02x, want %#02x", x, y, b, got, v)
+			}
+		}
+	}
+	return nil
+}
+
+func TestDecodeCoefficients(t *testing.T) {
+	for _, tc := range []struct {
+		filename string
+		nScans   int
+	}{
+		{"../testdata/video-001", 1},
+		{"../testdata/video-001.q50.410", 1},
+		{"../testdata/video-005.gray.q50", 1},
+		{"../testdata/video-001.q50.444", 1},
+		{"../testdata/video-005.gray.q50.2x2", 1},
+	} {
+		data, err := os.ReadFile(tc.filename + ".jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := DecodeCoefficients(context.Background(), bytes.NewReader(data), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.filename, err)
+		}
+		if len(c.Scans) != tc.nScans {
+			t.Errorf("%s: got %d scans, want %d", tc.filename, len(c.Scans), tc.nScans)
+		}
+		m, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Width != m.Bounds().Dx() || c.Height != m.Bounds().Dy() {
+			t.Errorf("%s: got size %dx%d, want %v", tc.filename, c.Width, c.Height, m.Bounds().Size())
+		}
+
+		// The inverse DCT of the dequantized coefficients should give the
+		// decoded samples.
+		var planes [][]byte
+		var strides []int
+		switch m := m.(type) {
+		case *image.Gray:
+			planes, strides = [][]byte{m.Pix}, []int{m.Stride}
+		case *image.YCbCr:
+			planes, strides = [][]byte{m.Y, m.Cb, m.Cr}, []int{m.YStride, m.CStride, m.CStride}
+		}
+		for i, cc := range c.Components {
+			w := (c.Width*cc.H + 8*c.Components[0].H - 1) / (8 * c.Components[0].H)
+			h := (c.Height*cc.V + 8*c.Components[0].V - 1) / (8 * c.Components[0].V)
+			for by := 0; by < h/8; by++ {
+				for bx := 0; bx < w/8; bx++ {
+					b := block(cc.Blocks[by*cc.BlocksWide+bx])
+					for j := range b {
+						b[j] *= cc.Quant[j]
+					}
+					idct(&b)
+					for y := 0; y < 8; y++ {
+						for x := 0; x < 8; x++ {
+							v := min(max(b[8*y+x]+128, 0), 255)
+							if got := planes[i][(8*by+y)*strides[i]+8*bx+x]; int32(got) != v {
+								t.Fatalf("%s: component %d, block (%d, %d): got sample %d, want %d", tc.filename, i, bx, by, got, v)
+							}
+						}
+					}
+				}
+			}
+		}
+
+		// The progressive version of the image has the same coefficients.
+		data, err = os.ReadFile(tc.filename + ".progressive.jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := DecodeCoefficients(context.Background(), bytes.NewReader(data), &CoefficientOptions{ZigZag: true})
+		if err != nil {
+			t.Fatalf("%s: progressive: %v", tc.filename, err)
+		}
+		if !p.Progressive || len(p.Scans) <= 1 {
+			t.Errorf("%s: progressive: got Progressive %t and %d scans", tc.filename, p.Progressive, len(p.Scans))
+		}
+		for i, cc := range c.Components {
+			pc := p.Components[i]
+			if unzigBlock(pc.Quant) != cc.Quant {
+				t.Errorf("%s: component %d: quantization tables differ", tc.filename, i)
+			}
+			for j, b := range cc.Blocks {
+				if unzigBlock(pc.Blocks[j]) != b {
+					t.Errorf("%s: component %d: block %d differs", tc.filename, i, j)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	for _, filename := range []string{
+		"../testdata/video-001.restart2.jpeg",
+		"../testdata/video-001.progressive.jpeg",
+		"../testdata/video-001.arithmetic.jpeg",
+	} {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var markers []uint8
+		nRST := 0
+		for s, err := range Segments(bytes.NewReader(data)) {
+			if err != nil {
+				t.Fatalf("%s: %v", filename, err)
+			}
+			markers = append(markers, s.Marker)
+			if data[s.Offset] != 0xff || data[s.Offset+1] != s.Marker {
+				t.Fatalf("%s: marker %#x is not at offset %d", filename, s.Marker, s.Offset)
+			}
+			if s.Length == 0 {
+				continue
+			}
+			if got := int(data[s.Offset+2])<<8 | int(data[s.Offset+3]); got != s.Length || !bytes.Equal(s.Data, data[s.Offset+4:s.Offset+2+int64(s.Length)]) {
+				t.Errorf("%s: marker %#x at offset %d: wrong length or data", filename, s.Marker, s.Offset)
+			}
+			if s.Marker != sosMarker {
+				continue
+			}
+			if s.ScanOffset != s.Offset+2+int64(s.Length) || !bytes.Equal(s.Scan, data[s.ScanOffset:s.ScanOffset+int64(len(s.Scan))]) {
+				t.Errorf("%s: scan at offset %d: wrong entropy-coded data", filename, s.Offset)
+			}
+			for k, o := range s.RSTOffsets {
+				if data[o] != 0xff || data[o+1] != rst0Marker+uint8(k%8) {
+					t.Errorf("%s: scan at offset %d: no RST%d marker at offset %d", filename, s.Offset, k%8, o)
+				}
+			}
+			nRST += len(s.RSTOffsets)
+		}
+		if len(markers) < 2 || markers[0] != soiMarker || markers[len(markers)-1] != eoiMarker {
+			t.Errorf("%s: got markers % x", filename, markers)
+		}
+		if strings.Contains(filename, "restart") != (nRST > 0) {
+			t.Errorf("%s: got %d RST markers", filename, nRST)
+		}
+	}
+
+	data, err := os.ReadFile("../testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The iteration can stop early.
+	n := 0
+	for range Segments(bytes.NewReader(data)) {
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	// Fill bytes before a marker are skipped. Other bytes after a scan are
+	// part of its entropy-coded data.
+	eoi := len(data) - 2
+	junk := append(append(data[:eoi:eoi], "\x00\x01\xff\xff"...), data[eoi:]...)
+	var last *SegmentInfo
+	for s, err := range Segments(bytes.NewReader(junk)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = s
+	}
+	if last.Marker != eoiMarker || last.Offset != int64(eoi)+4 {
+		t.Errorf("got marker %#x at offset %d, want EOI at offset %d", last.Marker, last.Offset, eoi+4)
+	}
+	// Truncated data ends the iteration with an error.
+	var gotErr error
+	for _, err := range Segments(bytes.NewReader(data[:len(data)/2])) {
+		gotErr = err
+	}
+	if gotErr != io.ErrUnexpectedEOF {
+		t.Errorf("truncated: got %v, want %v", gotErr, io.ErrUnexpectedEOF)
+	}
+}
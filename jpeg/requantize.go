@@ -0,0 +1,82 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import "errors"
+
+// RequantizeOptions are the parameters for Requantize.
+type RequantizeOptions struct {
+	// Quality is as for Options, and chooses the quantization tables that
+	// Encode would use: the luminance one for the first component and the
+	// chrominance one for the others. It is only used if Quant is nil.
+	Quality int
+	// Quant, if not nil, is the new quantization table of each component.
+	// They are in the same order as the Coefficients' blocks.
+	Quant []Block
+}
+
+// Requantize changes the quantization tables of c to those that o specifies,
+// and requantizes each coefficient for its new table, rounding to the
+// nearest value. This is done without an inverse or forward DCT, or any
+// color conversion or chroma resampling, so that the image loses no more
+// than the coarser quantization loses. The coefficients are clamped to the
+// range of the DCT of 8-bit samples, which a finer table could otherwise
+// take them out of, so that EncodeCoefficients can encode them. Default
+// parameters are used if a nil *RequantizeOptions is passed.
+func Requantize(c *Coefficients, o *RequantizeOptions) error {
+	if o == nil {
+		o = &RequantizeOptions{Quality: DefaultQuality}
+	}
+	quant := o.Quant
+	if quant == nil {
+		q := quantTables(o.Quality)
+		for i := range c.Components {
+			var table Block
+			for j, x := range q[min(i, 1)] {
+				table[j] = int32(x)
+			}
+			if !c.ZigZag {
+				table = unzigBlock(table)
+			}
+			quant = append(quant, table)
+		}
+	}
+	if len(quant) != len(c.Components) {
+		return errors.New("jpeg: wrong number of quantization tables")
+	}
+	for i := range c.Components {
+		for j, x := range quant[i] {
+			if x < 1 || x > 0xffff || c.Components[i].Quant[j] < 1 {
+				return errors.New("jpeg: invalid quantization table")
+			}
+		}
+	}
+
+	for i := range c.Components {
+		cc := &c.Components[i]
+		for k := range cc.Blocks {
+			b := &cc.Blocks[k]
+			for j, x := range b {
+				// Round the DCT coefficient, divided by its new quantization
+				// value, to the nearest integer, with halves rounded away from
+				// zero.
+				v := int64(x) * int64(cc.Quant[j])
+				q := int64(quant[i][j])
+				if v < 0 {
+					v = -((-v + q/2) / q)
+				} else {
+					v = (v + q/2) / q
+				}
+				lo, hi := int64(-maxAC), int64(maxAC)
+				if j == 0 {
+					lo = -1 << 10
+				}
+				b[j] = int32(min(max(v, lo), hi))
+			}
+		}
+		cc.Quant = quant[i]
+	}
+	return nil
+}
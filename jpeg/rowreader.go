@@ -0,0 +1,145 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"image"
+	"io"
+)
+
+// A RowReader decodes a JPEG image incrementally, one strip of rows at a
+// time, like libjpeg's jpeg_read_scanlines. Each strip is one MCU (Minimum
+// Coded Unit) row high: 8 or 16 rows for most images, fewer when scaling.
+//
+// For sequential images whose components are interleaved in a single scan,
+// which is almost all of them, only one MCU row of the image is held in
+// memory. Other images, including all progressive images, have scans that
+// each cover the whole image, so their coefficients are buffered until the
+// last scan, and the strips are then reconstructed from them one at a time.
+type RowReader struct {
+	d   decoder
+	err error
+	// my is the next MCU row to decode, and myEnd is the MCU row after the
+	// last one to decode.
+	my, myEnd int
+}
+
+// NewRowReader returns a RowReader that reads a JPEG image from r. It reads
+// the input up to the start of the image data. Default parameters are used
+// if a nil *[DecoderOptions] is passed. The Partial and Intermediate options
+// are not supported.
+func NewRowReader(r io.Reader, o *DecoderOptions) (*RowReader, error) {
+	rr := &RowReader{}
+	d := &rr.d
+	if o != nil {
+		d.opts = *o
+	}
+	d.opts.Partial = false
+	d.opts.Intermediate = nil
+	d.streaming = true
+	if _, err := d.decode(r, false); err != nil {
+		return nil, d.wrapError(err)
+	}
+	if d.img1 == nil && d.img3 == nil {
+		return nil, d.wrapError(FormatError("missing SOS marker"))
+	}
+	rr.my, rr.myEnd = d.cropMCUs.Min.Y, d.cropMCUs.Max.Y
+	if d.streamScan != nil {
+		// The rows above the image bounds still have to be decoded, but the
+		// rows below them do not.
+		rr.my = 0
+	}
+	return rr, nil
+}
+
+// Bounds returns the bounds of the image. They are those of the image that
+// [DecodeContext] would return for the same options.
+func (rr *RowReader) Bounds() image.Rectangle {
+	return rr.d.bounds
+}
+
+// Next returns the next strip of the image, or io.EOF after the last one.
+// The strip is only valid until the next call to Next, as its pixel buffer
+// is reused. The strips together cover Bounds. When the Resync option is set,
+// a *[DamagedError] is returned after the last strip if any part of the
+// image was damaged.
+func (rr *RowReader) Next() (image.Image, error) {
+	if rr.err != nil {
+		return nil, rr.err
+	}
+	m, err := rr.next()
+	if err != nil {
+		rr.err = rr.d.wrapError(err)
+		return nil, rr.err
+	}
+	return m, nil
+}
+
+func (rr *RowReader) next() (image.Image, error) {
+	d := &rr.d
+	for rr.my < rr.myEnd {
+		my := rr.my
+		rr.my++
+		visible := d.cropMCUs.Min.Y <= my
+		if visible {
+			d.setMCURow(my)
+		} else {
+			// Decode the row, but don't reconstruct it.
+			d.mcus.Min.Y, d.mcus.Max.Y = my, my
+		}
+
+		if s := d.streamScan; s != nil {
+			if err := d.decodeMCURow(s, my); err != nil {
+				return nil, err
+			}
+			if rr.my == s.myy {
+				if err := rr.finish(); err != nil {
+					return nil, err
+				}
+			}
+		} else if err := d.reconstructCoeffs(my, my+1, false); err != nil {
+			return nil, err
+		}
+
+		if visible {
+			return d.image()
+		}
+	}
+	if len(d.damaged) > 0 {
+		return nil, &DamagedError{Regions: d.damaged}
+	}
+	return nil, io.EOF
+}
+
+// finish processes the segments after the streamed scan, up to the EOI
+// marker.
+func (rr *RowReader) finish() error {
+	d := &rr.d
+	d.streamScan = nil
+	if _, err := d.decodeSegments(false); err != nil {
+		return err
+	}
+	if d.streamScan != nil {
+		return UnsupportedError("more than one scan with interleaved components")
+	}
+	return nil
+}
+
+// setMCURow sets the img1 or img3 buffer, which holds one MCU row when
+// streaming, to hold the given row.
+func (d *decoder) setMCURow(my int) {
+	d.mcus.Min.Y, d.mcus.Max.Y = my, my+1
+	h0, v0 := d.comp[0].h, d.comp[0].v
+	if d.nComp == 1 {
+		h0, v0 = 1, 1
+	}
+	mw, mh := d.blockDim*h0, d.blockDim*v0
+	r := image.Rect(mw*d.mcus.Min.X, mh*my, mw*d.mcus.Max.X, mh*(my+1))
+	if d.img1 != nil {
+		d.img1.Rect = r
+	} else {
+		d.img3.Rect = r
+	}
+}
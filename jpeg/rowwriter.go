@@ -0,0 +1,166 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// A RowWriter encodes a JPEG image incrementally, from strips of rows
+// written in order, like libjpeg's jpeg_write_scanlines. Only one MCU
+// (Minimum Coded Unit) row of the image, 8 rows for a grayscale image and 16
+// otherwise, is held in memory.
+//
+// When the strips are all *image.Gray and the image is grayscale, or none
+// are and it is not, the output is the same as that of [Encode] for an image
+// made of the strips.
+type RowWriter struct {
+	e encoder
+	// width and height are the image dimensions.
+	width, height int
+	// buf holds the rows of the current MCU row that have been written so
+	// far. Its bounds are those rows. It is an *image.Gray for a grayscale
+	// image, and an *image.YCbCr with 4:4:4 subsampling otherwise.
+	buf image.Image
+	// y is the number of rows written.
+	y   int
+	err error
+}
+
+// NewRowWriter returns a RowWriter that writes a JPEG image with the
+// dimensions of c to w. It writes a grayscale JPEG, as Encode does for an
+// *image.Gray, if c.ColorModel is color.GrayModel, and a 4:2:0 YCbCr JPEG
+// otherwise. Default parameters are used if a nil *[Options] is passed.
+func NewRowWriter(w io.Writer, c image.Config, o *Options) (*RowWriter, error) {
+	if c.Width < 0 || c.Height < 0 {
+		return nil, errors.New("jpeg: invalid image size")
+	}
+	if c.Width >= 1<<16 || c.Height >= 1<<16 {
+		return nil, errors.New("jpeg: image is too large to encode")
+	}
+	rw := &RowWriter{width: c.Width, height: c.Height}
+	if err := rw.e.init(w, o); err != nil {
+		return nil, err
+	}
+	nComponent := 3
+	if c.ColorModel == color.GrayModel {
+		nComponent = 1
+		rw.buf = image.NewGray(image.Rect(0, 0, c.Width, 8))
+	} else {
+		rw.buf = image.NewYCbCr(image.Rect(0, 0, c.Width, 16), image.YCbCrSubsampleRatio444)
+	}
+	rw.e.writeHeader(image.Pt(c.Width, c.Height), nComponent)
+	rw.e.writeSOSHeader(nComponent == 1)
+	rw.setBufRows(0, 0)
+	return rw, rw.e.err
+}
+
+// WriteRows writes the rows of m, which must be the next rows of the image
+// and span its full width. Where m's bounds start horizontally does not
+// matter. m may be of any type, though an *image.Gray, *image.RGBA or
+// *image.YCbCr is faster to encode.
+func (rw *RowWriter) WriteRows(m image.Image) error {
+	if rw.err != nil {
+		return rw.err
+	}
+	b := m.Bounds()
+	if b.Dx() != rw.width {
+		return errors.New("jpeg: rows are not the width of the image")
+	}
+	if rw.y+b.Dy() > rw.height {
+		return errors.New("jpeg: too many rows written")
+	}
+	for sy := b.Min.Y; sy < b.Max.Y; sy++ {
+		rw.copyRow(m, b.Min.X, sy)
+		rw.y++
+		if size := mcuSize(rw.buf); rw.y%size == 0 {
+			rw.e.writeMCURow(rw.buf, rw.y-size)
+			rw.setBufRows(rw.y, rw.y)
+		}
+	}
+	rw.err = rw.e.err
+	return rw.err
+}
+
+// Close writes the end of the image, and flushes the output. It is an error
+// if fewer rows than the height of the image have been written. Close does
+// not close the underlying writer.
+func (rw *RowWriter) Close() error {
+	if rw.err != nil {
+		return rw.err
+	}
+	if rw.y < rw.height {
+		rw.err = errors.New("jpeg: RowWriter closed before all rows were written")
+		return rw.err
+	}
+	if y0 := rw.buf.Bounds().Min.Y; y0 < rw.y {
+		// The last MCU row is incomplete, so it replicates its last row.
+		rw.e.writeMCURow(rw.buf, y0)
+	}
+	rw.e.finishSOS()
+	rw.e.writeEOI()
+	rw.err = rw.e.err
+	if rw.err == nil {
+		rw.err = errors.New("jpeg: RowWriter is closed")
+		return nil
+	}
+	return rw.err
+}
+
+// setBufRows sets the bounds of buf to the rows from y0 to y1, reusing its
+// pixel buffer from the top.
+func (rw *RowWriter) setBufRows(y0, y1 int) {
+	r := image.Rect(0, y0, rw.width, y1)
+	switch buf := rw.buf.(type) {
+	case *image.Gray:
+		buf.Rect = r
+	case *image.YCbCr:
+		buf.Rect = r
+	}
+}
+
+// copyRow appends row sy of m, whose left edge is x0, to buf, converting it
+// in the same way as Encode.
+func (rw *RowWriter) copyRow(m image.Image, x0, sy int) {
+	y0 := rw.buf.Bounds().Min.Y
+	rw.setBufRows(y0, rw.y+1)
+	switch buf := rw.buf.(type) {
+	case *image.Gray:
+		dst := buf.Pix[buf.PixOffset(0, rw.y):][:rw.width]
+		if m, ok := m.(*image.Gray); ok {
+			copy(dst, m.Pix[m.PixOffset(x0, sy):])
+			return
+		}
+		for i := range dst {
+			dst[i] = color.GrayModel.Convert(m.At(x0+i, sy)).(color.Gray).Y
+		}
+	case *image.YCbCr:
+		i0 := buf.YOffset(0, rw.y)
+		yy := buf.Y[i0 : i0+rw.width]
+		cb := buf.Cb[i0 : i0+rw.width]
+		cr := buf.Cr[i0 : i0+rw.width]
+		switch m := m.(type) {
+		case *image.RGBA:
+			pix := m.Pix[m.PixOffset(x0, sy):]
+			for i := range yy {
+				yy[i], cb[i], cr[i] = color.RGBToYCbCr(pix[4*i], pix[4*i+1], pix[4*i+2])
+			}
+		case *image.YCbCr:
+			for i := range yy {
+				yy[i] = m.Y[m.YOffset(x0+i, sy)]
+				ci := m.COffset(x0+i, sy)
+				cb[i], cr[i] = m.Cb[ci], m.Cr[ci]
+			}
+		default:
+			for i := range yy {
+				r, g, b, _ := m.At(x0+i, sy).RGBA()
+				yy[i], cb[i], cr[i] = color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"math"
+)
+
+// This file implements the reduced-size inverse DCTs used for scaled
+// decoding. An n×n IDCT of the lowest n×n frequencies of an 8×8 block gives
+// an n×n image of the block, at n/8 of its size, as per libjpeg's jidctred.c.
+
+// scaledIDCTCos holds, for n = 2 and 4, the 13-bit fixed point value of
+// C(u) * cos((2x+1)uπ/2n) / 2 at [n][x][u], where C(0) = 1/√2 and C(u) = 1
+// otherwise. Applying it in both dimensions gives the same 1/4 overall
+// factor as the full 8×8 IDCT, so that a block's DC coefficient maps to the
+// average of its samples.
+var scaledIDCTCos = func() (c [5][4][4]int32) {
+	for _, n := range []int{2, 4} {
+		for x := 0; x < n; x++ {
+			for u := 0; u < n; u++ {
+				f := math.Cos(float64((2*x+1)*u) * math.Pi / float64(2*n))
+				if u == 0 {
+					f = math.Sqrt2 / 2
+				}
+				c[n][x][u] = int32(math.Round(f / 2 * (1 << constBits)))
+			}
+		}
+	}
+	return c
+}()
+
+// scaledIDCT performs an n×n inverse DCT on the top-left n×n coefficients of
+// src, for n = 1, 2 or 4. Like idct, the coefficients should already have
+// been dequantized. The n×n result is stored in the top-left of src, with a
+// row stride of 8.
+func scaledIDCT(src *block, n int) {
+	if n == 1 {
+		src[0] = (src[0] + 4) >> 3
+		return
+	}
+	c := &scaledIDCTCos[n]
+
+	// Horizontal 1-D IDCT, keeping pass1Bits of extra precision.
+	var tmp [4 * 4]int32
+	for v := 0; v < n; v++ {
+		s := src[8*v : 8*v+4 : 8*v+4]
+		for x := 0; x < n; x++ {
+			sum := int32(1 << (constBits - pass1Bits - 1))
+			for u := 0; u < n; u++ {
+				sum += c[x][u] * s[u]
+			}
+			tmp[4*v+x] = sum >> (constBits - pass1Bits)
+		}
+	}
+
+	// Vertical 1-D IDCT.
+	for x := 0; x < n; x++ {
+		for y := 0; y < n; y++ {
+			sum := int32(1 << (constBits + pass1Bits - 1))
+			for v := 0; v < n; v++ {
+				sum += c[y][v] * tmp[4*v+x]
+			}
+			src[8*y+x] = sum >> (constBits + pass1Bits)
+		}
+	}
+}
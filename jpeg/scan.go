@@ -8,16 +8,41 @@ import (
 	"image"
 )
 
-// makeImg allocates and initializes the destination image.
-func (d *decoder) makeImg(mxx, myy int) {
+// makeImg allocates and initializes the destination image. Only the MCUs
+// that overlap the image bounds are allocated.
+func (d *decoder) makeImg() error {
+	bounds, err := d.imageBounds()
+	if err != nil {
+		return err
+	}
+	h0, v0 := d.comp[0].h, d.comp[0].v
 	if d.nComp == 1 {
-		m := image.NewGray(image.Rect(0, 0, 8*mxx, 8*myy))
-		d.img1 = m.SubImage(image.Rect(0, 0, d.width, d.height)).(*image.Gray)
-		return
+		h0, v0 = 1, 1
+	}
+	bd := d.blockDim
+	mw, mh := bd*h0, bd*v0 // The MCU size, in pixels.
+	d.bounds = bounds
+	d.cropMCUs = image.Rect(
+		bounds.Min.X/mw, bounds.Min.Y/mh,
+		(bounds.Max.X+mw-1)/mw, (bounds.Max.Y+mh-1)/mh,
+	)
+	d.mcus = d.cropMCUs
+	if d.streaming {
+		// Only one MCU row at a time is decoded into the buffer.
+		d.mcus.Max.Y = d.mcus.Min.Y + 1
+	}
+	r := image.Rect(mw*d.mcus.Min.X, mh*d.mcus.Min.Y, mw*d.mcus.Max.X, mh*d.mcus.Max.Y)
+	if d.nComp == 1 {
+		if m := d.dstGray(r); m != nil {
+			d.img1 = m
+		} else if m := d.pool.img1; m != nil && m.Rect == r {
+			d.img1 = m
+		} else {
+			d.img1 = image.NewGray(r)
+		}
+		return d.checkDst()
 	}
 
-	h0 := d.comp[0].h
-	v0 := d.comp[0].v
 	hRatio := h0 / d.comp[1].h
 	vRatio := v0 / d.comp[1].v
 	var subsampleRatio image.YCbCrSubsampleRatio
@@ -37,14 +62,25 @@ func (d *decoder) makeImg(mxx, myy int) {
 	default:
 		panic("unreachable")
 	}
-	m := image.NewYCbCr(image.Rect(0, 0, 8*h0*mxx, 8*v0*myy), subsampleRatio)
-	d.img3 = m.SubImage(image.Rect(0, 0, d.width, d.height)).(*image.YCbCr)
+	if m := d.dstYCbCr(r, subsampleRatio); m != nil {
+		d.img3 = m
+	} else if m := d.pool.img3; m != nil && m.Rect == r && m.SubsampleRatio == subsampleRatio {
+		d.img3 = m
+	} else {
+		d.img3 = image.NewYCbCr(r, subsampleRatio)
+	}
 
 	if d.nComp == 4 {
 		h3, v3 := d.comp[3].h, d.comp[3].v
-		d.blackPix = make([]byte, 8*h3*mxx*8*v3*myy)
-		d.blackStride = 8 * h3 * mxx
+		n := bd * h3 * d.mcus.Dx() * bd * v3 * d.mcus.Dy()
+		if cap(d.pool.blackPix) >= n {
+			d.blackPix = d.pool.blackPix[:n]
+		} else {
+			d.blackPix = make([]byte, n)
+		}
+		d.blackStride = bd * h3 * d.mcus.Dx()
 	}
+	return d.checkDst()
 }
 
 // Decode the DC delta coefficient, as specified in section F.2.2.1 (Huffman) or F.2.4.1 (Arithmetic).
@@ -64,9 +100,10 @@ func (d *decoder) decodeDC(arith *[maxTc + 1][maxTb + 1]arithmetic, td uint8, pr
 }
 
 // Decode the run length and AC coefficient, as specified in section F.2.2.2 (Huffman) or F.2.4.2 (Arithmetic).
-func (d *decoder) decodeAC(arith *[maxTc + 1][maxTb + 1]arithmetic, ta uint8, k uint8) (uint8, int32, uint16, error) {
+// The coefficient is at k or after it, up to end.
+func (d *decoder) decodeAC(arith *[maxTc + 1][maxTb + 1]arithmetic, ta uint8, k uint8, end uint8) (uint8, int32, uint16, error) {
 	if d.arithmetic {
-		r, ac, eob, err := d.decodeArithmeticAC(&arith[acTable][ta], &d.arithAcCond[ta], k)
+		r, ac, eob, err := d.decodeArithmeticAC(&arith[acTable][ta], &d.arithAcCond[ta], k, end)
 		if err != nil {
 			return 0, 0, 0, err
 		}
@@ -105,8 +142,43 @@ func (d *decoder) decodeAC(arith *[maxTc + 1][maxTb + 1]arithmetic, ta uint8, k
 	}
 }
 
+// scanState is the state of the scan being decoded by processSOS.
+type scanState struct {
+	nComp int
+	comp  [maxComponents]struct {
+		compIndex uint8
+		td        uint8 // DC table selector.
+		ta        uint8 // AC table selector.
+	}
+
+	// zigStart, zigEnd, ah and al are described in processSOS.
+	zigStart, zigEnd uint8
+	ah, al           uint32
+
+	// mxx and myy are the number of MCUs (Minimum Coded Units) in the scan.
+	// They are those of the image, unless the scan is non-interleaved, when
+	// each MCU is a single block. imageMxx is the number of MCUs across the
+	// image.
+	mxx, myy, imageMxx int
+
+	dc          [maxComponents]int32
+	prevDcDelta [maxComponents]int32
+	// Arithmetic state
+	arith [maxTc + 1][maxTb + 1]arithmetic
+
+	mcu         int
+	expectedRST uint8
+	// skip is whether the rest of the current restart interval is missing
+	// or corrupt, and is skipped over instead of being decoded.
+	skip bool
+	// outside is whether the current restart interval is outside the image
+	// bounds, and its data has been skipped over.
+	outside bool
+}
+
 // Specified in section B.2.3.
 func (d *decoder) processSOS(n int) error {
+	d.mcu = image.Point{}
 	if d.nComp == 0 {
 		return FormatError("missing SOF marker")
 	}
@@ -120,11 +192,9 @@ func (d *decoder) processSOS(n int) error {
 	if n != 4+2*nComp {
 		return FormatError("SOS length inconsistent with number of components")
 	}
-	var scan [maxComponents]struct {
-		compIndex uint8
-		td        uint8 // DC table selector.
-		ta        uint8 // AC table selector.
-	}
+	s := &d.scan
+	*s = scanState{nComp: nComp}
+	scan := &s.comp
 	totalHV := 0
 	for i := 0; i < nComp; i++ {
 		cs := d.tmp[1+2*i] // Component selector.
@@ -200,173 +270,340 @@ func (d *decoder) processSOS(n int) error {
 		}
 	}
 
+	s.zigStart, s.zigEnd, s.ah, s.al = zigStart, zigEnd, ah, al
+	if d.opts.Preview && zigStart != 0 {
+		// Only the DC coefficients are needed for a preview.
+		return d.skipScan(false)
+	}
+
 	// mxx and myy are the number of MCUs (Minimum Coded Units) in the image.
 	h0, v0 := d.comp[0].h, d.comp[0].v // The h and v values from the Y components.
 	mxx := (d.width + 8*h0 - 1) / (8 * h0)
 	myy := (d.height + 8*v0 - 1) / (8 * v0)
-	if d.img1 == nil && d.img3 == nil {
-		d.makeImg(mxx, myy)
+	s.mxx, s.myy, s.imageMxx = mxx, myy, mxx
+	if nComp == 1 && d.nComp != 1 {
+		// As per section A.2.2, a non-interleaved scan has an MCU for each
+		// block that covers the component's samples, which may be fewer
+		// than the blocks in the image's MCUs, and restart intervals count
+		// those blocks.
+		c := &d.comp[scan[0].compIndex]
+		s.mxx = ((d.width*c.h+h0-1)/h0 + 7) / 8
+		s.myy = ((d.height*c.v+v0-1)/v0 + 7) / 8
 	}
-	if d.progressive {
+	if d.coeffsOnly {
+		// DecodeCoefficients has no image, and keeps the coefficients from
+		// every scan.
+		d.keepCoeffs = true
+		d.scans = append(d.scans, Scan{
+			Components:    make([]int, nComp),
+			SpectralStart: int(zigStart),
+			SpectralEnd:   int(zigEnd),
+			ApproxHigh:    int(ah),
+			ApproxLow:     int(al),
+		})
+		for i := 0; i < nComp; i++ {
+			d.scans[len(d.scans)-1].Components[i] = int(scan[i].compIndex)
+		}
+	} else if d.img1 == nil && d.img3 == nil {
+		// The coefficients are kept until after the last scan for
+		// progressive images, and for non-interleaved images that are being
+		// streamed, as they have a scan per component.
+		d.keepCoeffs = d.progressive || (d.streaming && nComp != d.nComp)
+		if err := d.makeImg(); err != nil {
+			return err
+		}
+		if d.opts.Partial {
+			// Pre-fill the image with mid gray, in case the input is truncated.
+			for i := 0; i < d.nComp; i++ {
+				d.fillComponent(i, 0x80)
+			}
+		}
+	}
+	if d.keepCoeffs {
 		for i := 0; i < nComp; i++ {
 			compIndex := scan[i].compIndex
 			if d.progCoeffs[compIndex] == nil {
-				d.progCoeffs[compIndex] = make([]block, mxx*myy*d.comp[compIndex].h*d.comp[compIndex].v)
+				n := mxx * myy * d.comp[compIndex].h * d.comp[compIndex].v
+				if buf := d.pool.coeffs[compIndex]; cap(buf) >= n {
+					d.progCoeffs[compIndex] = buf[:n]
+					clear(d.progCoeffs[compIndex])
+				} else {
+					d.progCoeffs[compIndex] = make([]block, n)
+				}
 			}
 		}
 	}
 
 	d.bits = bits{}
-	mcu, expectedRST := 0, uint8(rst0Marker)
-	var (
-		// b is the decoded coefficients, in natural (not zig-zag) order.
-		b           block
-		dc          [maxComponents]int32
-		prevDcDelta [maxComponents]int32
-		// bx and by are the location of the current block, in units of 8x8
-		// blocks: the third block in the first row has (bx, by) = (2, 0).
-		bx, by     int
-		blockCount int
-		// Arithmetic state
-		arith [maxTc + 1][maxTb + 1]arithmetic
-	)
+	s.expectedRST = rst0Marker
 	if d.arithmetic {
 		err := d.initDecodeArithmetic()
 		if err != nil {
 			return err
 		}
 	}
-	for my := 0; my < myy; my++ {
-		for mx := 0; mx < mxx; mx++ {
-			for i := 0; i < nComp; i++ {
-				compIndex := scan[i].compIndex
-				hi := d.comp[compIndex].h
-				vi := d.comp[compIndex].v
-				for j := 0; j < hi*vi; j++ {
-					// The blocks are traversed one MCU at a time. For 4:2:0 chroma
-					// subsampling, there are four Y 8x8 blocks in every 16x16 MCU.
-					//
-					// For a sequential 32x16 pixel image, the Y blocks visiting order is:
-					//	0 1 4 5
-					//	2 3 6 7
-					//
-					// For progressive images, the interleaved scans (those with nComp > 1)
-					// are traversed as above, but non-interleaved scans are traversed left
-					// to right, top to bottom:
-					//	0 1 2 3
-					//	4 5 6 7
-					// Only DC scans (zigStart == 0) can be interleaved. AC scans must have
-					// only one component.
-					//
-					// To further complicate matters, for non-interleaved scans, there is no
-					// data for any blocks that are inside the image at the MCU level but
-					// outside the image at the pixel level. For example, a 24x16 pixel 4:2:0
-					// progressive image consists of two 16x16 MCUs. The interleaved scans
-					// will process 8 Y blocks:
-					//	0 1 4 5
-					//	2 3 6 7
-					// The non-interleaved scans will process only 6 Y blocks:
-					//	0 1 2
-					//	3 4 5
-					if nComp != 1 {
-						bx = hi*mx + j%hi
-						by = vi*my + j/hi
-					} else {
-						q := mxx * hi
-						bx = blockCount % q
-						by = blockCount / q
-						blockCount++
-						if bx*8 >= d.width || by*8 >= d.height {
-							continue
-						}
-					}
+	if d.streaming && !d.keepCoeffs {
+		// The RowReader decodes the MCU rows one at a time.
+		d.streamScan = s
+		return nil
+	}
+	if d.decodesIntervals(s) {
+		if ok, err := d.decodeIntervals(s); ok || err != nil {
+			return err
+		}
+	}
+	for my := 0; my < s.myy; my++ {
+		if err := d.decodeMCURow(s, my); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-					// Load the previous partially decoded coefficients, if applicable.
-					if d.progressive {
-						b = d.progCoeffs[compIndex][by*mxx*hi+bx]
-					} else {
-						b = block{}
-					}
+// decodeMCURow decodes the MCUs in the given row of the scan.
+func (d *decoder) decodeMCURow(s *scanState, my int) error {
+	if err := d.checkContext(); err != nil {
+		return err
+	}
+	mxx, myy := s.mxx, s.myy
+	for mx := 0; mx < mxx; mx++ {
+		d.mcu = image.Point{mx, my}
+		if d.ri > 0 && s.mcu%d.ri == 0 && d.intervalOutside(s) {
+			// Skip to the restart marker at the end of the interval.
+			if err := d.skipScan(true); err != nil {
+				return err
+			}
+			s.outside = true
+		}
+		if err := d.decodeMCU(s, mx, my); err != nil {
+			return err
+		}
+		s.mcu++
+		if d.ri > 0 && s.mcu%d.ri == 0 && s.mcu < mxx*myy {
+			if err := d.processRST(s); err != nil {
+				return err
+			}
+		}
+	} // for mx
+	if d.opts.Progress != nil {
+		d.opts.Progress(Progress{
+			Scan:    d.nScan,
+			MCURow:  my + 1,
+			MCURows: myy,
+			Offset:  d.offset(),
+		})
+	}
+	return nil
+}
 
-					if ah != 0 {
-						if err := d.refine(&b, &d.huff[acTable][scan[i].ta], zigStart, zigEnd, 1<<al); err != nil {
-							return err
-						}
-					} else {
-						zig := zigStart
-						if zig == 0 {
-							zig++
-							dcDelta, err := d.decodeDC(&arith, scan[i].td, prevDcDelta[compIndex])
-							if err != nil {
-								return err
-							}
-							dc[compIndex] += dcDelta
-							prevDcDelta[compIndex] = dcDelta
-							b[0] = dc[compIndex] << al
-						}
+// decodeMCU decodes the MCU at (mx, my). If the Resync option is set, then
+// corrupt data causes the rest of the restart interval to be skipped, instead
+// of returning an error.
+func (d *decoder) decodeMCU(s *scanState, mx, my int) error {
+	if s.outside {
+		return nil
+	}
+	if !s.skip {
+		err := d.decodeBlocks(s, mx, my, false)
+		if err == nil || !d.resyncing() || !isCorrupt(err) {
+			return err
+		}
+		// Revisit this MCU's blocks, as some of them may have been decoded
+		// from the corrupt data.
+		s.skip = true
+	}
+	return d.decodeBlocks(s, mx, my, true)
+}
 
-						if zig <= zigEnd && d.eobRun > 0 {
-							d.eobRun--
-						} else {
-							// Decode the AC coefficients, as specified in section F.2.2.2.
-							for ; zig <= zigEnd; zig++ {
-								r, ac, eobRun, err := d.decodeAC(&arith, scan[i].ta, zig)
-								if err != nil {
-									return err
-								}
-								if eobRun > 0 {
-									d.eobRun = eobRun - 1
-									break
-								}
-								zig += r
-								b[unzig[zig]] = ac << al
-							}
-						}
-					}
+// decodeBlocks decodes the blocks of the MCU at (mx, my). If skip is true, no
+// data is read, and the blocks are marked as damaged instead.
+func (d *decoder) decodeBlocks(s *scanState, mx, my int, skip bool) error {
+	nComp, scan := s.nComp, &s.comp
+	zigStart, zigEnd, ah, al := s.zigStart, s.zigEnd, s.ah, s.al
+	mxx := s.imageMxx
+	var (
+		// b is the decoded coefficients, in natural (not zig-zag) order.
+		b block
+		// bx and by are the location of the current block, in units of 8x8
+		// blocks: the third block in the first row has (bx, by) = (2, 0).
+		bx, by int
+	)
+	if skip && nComp != 1 {
+		h0, v0 := d.comp[0].h, d.comp[0].v
+		d.addDamage(image.Rect(8*h0*mx, 8*v0*my, 8*h0*(mx+1), 8*v0*(my+1)))
+	}
+	for i := 0; i < nComp; i++ {
+		compIndex := scan[i].compIndex
+		hi := d.comp[compIndex].h
+		vi := d.comp[compIndex].v
+		nBlocks := hi * vi
+		if nComp == 1 {
+			nBlocks = 1
+		}
+		for j := 0; j < nBlocks; j++ {
+			// The blocks are traversed one MCU at a time. For 4:2:0 chroma
+			// subsampling, there are four Y 8x8 blocks in every 16x16 MCU.
+			//
+			// For a sequential 32x16 pixel image, the Y blocks visiting order is:
+			//	0 1 4 5
+			//	2 3 6 7
+			//
+			// For progressive images, the interleaved scans (those with nComp > 1)
+			// are traversed as above, but non-interleaved scans are traversed left
+			// to right, top to bottom:
+			//	0 1 2 3
+			//	4 5 6 7
+			// Only DC scans (zigStart == 0) can be interleaved. AC scans must have
+			// only one component.
+			//
+			// To further complicate matters, for non-interleaved scans, there is no
+			// data for any blocks that are inside the image at the MCU level but
+			// outside the image at the pixel level. For example, a 24x16 pixel 4:2:0
+			// progressive image consists of two 16x16 MCUs. The interleaved scans
+			// will process 8 Y blocks:
+			//	0 1 4 5
+			//	2 3 6 7
+			// The non-interleaved scans will process only 6 Y blocks:
+			//	0 1 2
+			//	3 4 5
+			// Each of those blocks is an MCU of the scan.
+			if nComp != 1 {
+				bx = hi*mx + j%hi
+				by = vi*my + j/hi
+			} else {
+				bx, by = mx, my
+			}
 
-					if d.progressive {
-						// Save the coefficients.
-						d.progCoeffs[compIndex][by*mxx*hi+bx] = b
-						// At this point, we could call reconstructBlock to dequantize and perform the
-						// inverse DCT, to save early stages of a progressive image to the *image.YCbCr
-						// buffers (the whole point of progressive encoding), but in Go, the jpeg.Decode
-						// function does not return until the entire image is decoded, so we "continue"
-						// here to avoid wasted computation. Instead, reconstructBlock is called on each
-						// accumulated block by the reconstructProgressiveImage method after all of the
-						// SOS markers are processed.
-						continue
-					}
-					if err := d.reconstructBlock(&b, bx, by, int(compIndex)); err != nil {
-						return err
-					}
-				} // for j
-			} // for i
-			mcu++
-			if d.ri > 0 && mcu%d.ri == 0 && mcu < mxx*myy {
-				// For well-formed input, the RST[0-7] restart marker follows
-				// immediately. For corrupt input, call findRST to try to
-				// resynchronize.
-				if err := d.readFull(d.tmp[:2]); err != nil {
+			if skip {
+				if nComp == 1 {
+					w := 8 * d.comp[0].h / hi
+					h := 8 * d.comp[0].v / vi
+					d.addDamage(image.Rect(w*bx, h*by, w*(bx+1), h*(by+1)))
+				}
+				// Damaged progressive blocks keep the coefficients from earlier
+				// scans. Damaged sequential blocks are mid gray.
+				if d.keepCoeffs {
+					continue
+				}
+				b = block{}
+				if err := d.reconstructBlock(&b, bx, by, int(compIndex)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			// Load the previous partially decoded coefficients, if applicable.
+			if d.keepCoeffs {
+				b = d.progCoeffs[compIndex][by*mxx*hi+bx]
+			} else {
+				b = block{}
+			}
+
+			if ah != 0 && d.arithmetic {
+				if err := d.refineArithmetic(&b, &s.arith[acTable][scan[i].ta], zigStart, zigEnd, 1<<al); err != nil {
+					return err
+				}
+			} else if ah != 0 {
+				if err := d.refine(&b, &d.huff[acTable][scan[i].ta], zigStart, zigEnd, 1<<al); err != nil {
 					return err
-				} else if d.tmp[0] != 0xff || d.tmp[1] != expectedRST {
-					if err := d.findRST(expectedRST); err != nil {
+				}
+			} else {
+				zig := zigStart
+				if zig == 0 {
+					zig++
+					dcDelta, err := d.decodeDC(&s.arith, scan[i].td, s.prevDcDelta[compIndex])
+					if err != nil {
 						return err
 					}
+					s.dc[compIndex] += dcDelta
+					s.prevDcDelta[compIndex] = dcDelta
+					b[0] = s.dc[compIndex] << al
 				}
-				expectedRST++
-				if expectedRST == rst7Marker+1 {
-					expectedRST = rst0Marker
+
+				if zig <= zigEnd && d.eobRun > 0 {
+					d.eobRun--
+				} else if d.opts.Preview && !d.progressive && !d.arithmetic {
+					if err := d.skipAC(&d.huff[acTable][scan[i].ta]); err != nil {
+						return err
+					}
+				} else {
+					// Decode the AC coefficients, as specified in section F.2.2.2.
+					for ; zig <= zigEnd; zig++ {
+						r, ac, eobRun, err := d.decodeAC(&s.arith, scan[i].ta, zig, zigEnd)
+						if err != nil {
+							return err
+						}
+						if eobRun > 0 {
+							d.eobRun = eobRun - 1
+							break
+						}
+						zig += r
+						if zig > zigEnd {
+							return FormatError("too many coefficients")
+						}
+						b[unzig[zig]] = ac << al
+					}
 				}
-				// Reset the Huffman decoder.
-				d.bits = bits{}
-				// Reset the DC components, as per section F.2.1.3.1.
-				dc = [maxComponents]int32{}
-				// Reset the progressive decoder state, as per section G.1.2.2.
-				d.eobRun = 0
 			}
-		} // for mx
-	} // for my
 
+			if d.keepCoeffs {
+				// Save the coefficients.
+				d.progCoeffs[compIndex][by*mxx*hi+bx] = b
+				// At this point, we could call reconstructBlock to dequantize and perform the
+				// inverse DCT, to save early stages of a progressive image to the *image.YCbCr
+				// buffers (the whole point of progressive encoding), but in Go, the jpeg.Decode
+				// function does not return until the entire image is decoded, so we "continue"
+				// here to avoid wasted computation. Instead, reconstructBlock is called on each
+				// accumulated block by the reconstructProgressiveImage method after all of the
+				// SOS markers are processed.
+				continue
+			}
+			if err := d.reconstructBlock(&b, bx, by, int(compIndex)); err != nil {
+				return err
+			}
+		} // for j
+	} // for i
+	return nil
+}
+
+// processRST processes the restart marker at the end of a restart interval,
+// and resets the decoder state for the next interval.
+func (d *decoder) processRST(s *scanState) error {
+	s.skip = false
+	s.outside = false
+	// For well-formed input, the RST[0-7] restart marker follows
+	// immediately. For corrupt input, call findRST or resyncRST to try to
+	// resynchronize.
+	if err := d.readFull(d.tmp[:2]); err != nil {
+		return err
+	} else if d.tmp[0] != 0xff || d.tmp[1] != s.expectedRST {
+		if d.resyncing() {
+			missing, err := d.resyncRST(s.expectedRST)
+			if err != nil {
+				return err
+			}
+			s.skip = missing
+		} else if err := d.findRST(s.expectedRST); err != nil {
+			return err
+		}
+	}
+	s.expectedRST++
+	if s.expectedRST == rst7Marker+1 {
+		s.expectedRST = rst0Marker
+	}
+	// Reset the Huffman decoder.
+	d.bits = bits{}
+	// Reset the DC components, as per section F.2.1.3.1.
+	s.dc = [maxComponents]int32{}
+	// Reset the progressive decoder state, as per section G.1.2.2.
+	d.eobRun = 0
+	if d.arithmetic {
+		// Reset the arithmetic decoder and its statistics, as per section
+		// F.2.4.4.
+		s.arith = [maxTc + 1][maxTb + 1]arithmetic{}
+		s.prevDcDelta = [maxComponents]int32{}
+		return d.initDecodeArithmetic()
+	}
 	return nil
 }
 
@@ -394,7 +631,7 @@ func (d *decoder) refine(b *block, h *huffman, zigStart uint8, zigEnd uint8, del
 	loop:
 		for ; zig <= zigEnd; zig++ {
 			z := int32(0)
-			value, err := d.decodeHuffman(h) // FIXME: Arithmetic
+			value, err := d.decodeHuffman(h)
 			if err != nil {
 				return err
 			}
@@ -476,59 +713,143 @@ func (d *decoder) refineNonZeroes(b *block, zig uint8, zigEnd uint8, nz, delta i
 	return zig, nil
 }
 
-func (d *decoder) reconstructProgressiveImage() error {
+// reconstructProgressiveImage dequantizes and performs the inverse DCT on the
+// accumulated progressive coefficients. If intermediate is true, then the
+// coefficients are left intact so that later scans can refine them, and
+// components without any coefficients yet are filled with mid gray.
+func (d *decoder) reconstructProgressiveImage(intermediate bool) error {
+	return d.reconstructCoeffs(d.cropMCUs.Min.Y, d.cropMCUs.Max.Y, intermediate)
+}
+
+// reconstructCoeffs is like reconstructProgressiveImage, but only for the
+// MCU rows in [my0, my1).
+func (d *decoder) reconstructCoeffs(my0, my1 int, intermediate bool) error {
+	for i := 0; i < d.nComp; i++ {
+		if d.progCoeffs[i] == nil {
+			if intermediate {
+				d.fillComponent(i, 0x80)
+			} else if d.pooled {
+				// Clear what a previous image left in the buffer.
+				d.fillComponent(i, 0)
+			}
+		}
+	}
+	if d.opts.Workers > 1 {
+		return d.reconstructConcurrently(my0, my1, intermediate)
+	}
+	for i := 0; i < d.nComp; i++ {
+		if err := d.reconstructComponent(i, my0, my1, intermediate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconstructComponent reconstructs the given component's blocks in the MCU
+// rows in [my0, my1), if it has any coefficients.
+func (d *decoder) reconstructComponent(i, my0, my1 int, intermediate bool) error {
+	if d.progCoeffs[i] == nil {
+		return nil
+	}
 	// The h0, mxx, by and bx variables have the same meaning as in the
 	// processSOS method.
 	h0 := d.comp[0].h
 	mxx := (d.width + 8*h0 - 1) / (8 * h0)
-	for i := 0; i < d.nComp; i++ {
-		if d.progCoeffs[i] == nil {
-			continue
-		}
-		v := 8 * d.comp[0].v / d.comp[i].v
-		h := 8 * d.comp[0].h / d.comp[i].h
-		stride := mxx * d.comp[i].h
-		for by := 0; by*v < d.height; by++ {
-			for bx := 0; bx*h < d.width; bx++ {
-				if err := d.reconstructBlock(&d.progCoeffs[i][by*stride+bx], bx, by, i); err != nil {
-					return err
-				}
+	v := 8 * d.comp[0].v / d.comp[i].v
+	h := 8 * d.comp[0].h / d.comp[i].h
+	stride := mxx * d.comp[i].h
+	for by := my0 * d.comp[i].v; by < my1*d.comp[i].v && by*v < d.height; by++ {
+		for bx := 0; bx*h < d.width; bx++ {
+			b := &d.progCoeffs[i][by*stride+bx]
+			if intermediate {
+				tmp := *b
+				b = &tmp
+			}
+			if err := d.reconstructBlock(b, bx, by, i); err != nil {
+				return err
 			}
 		}
 	}
 	return nil
 }
 
+// fillComponent sets every sample of the given component to v.
+func (d *decoder) fillComponent(compIndex int, v byte) {
+	var pix []byte
+	stride, width := 0, 0
+	if d.nComp == 1 {
+		pix, stride, width = d.img1.Pix, d.img1.Stride, d.img1.Rect.Dx()
+	} else {
+		r := d.img3.Rect
+		cw := d.img3.COffset(r.Max.X-1, r.Min.Y) + 1
+		switch compIndex {
+		case 0:
+			pix, stride, width = d.img3.Y, d.img3.YStride, r.Dx()
+		case 1:
+			pix, stride, width = d.img3.Cb, d.img3.CStride, cw
+		case 2:
+			pix, stride, width = d.img3.Cr, d.img3.CStride, cw
+		case 3:
+			pix, stride, width = d.blackPix, d.blackStride, d.blackStride
+		}
+	}
+	// Only the samples in each row are set, as the image that DecodeInto
+	// decodes into may be part of a larger one.
+	for i := 0; i < len(pix); i += stride {
+		row := pix[i:min(i+width, len(pix))]
+		for j := range row {
+			row[j] = v
+		}
+	}
+}
+
 // reconstructBlock dequantizes, performs the inverse DCT and stores the block
 // to the image.
 func (d *decoder) reconstructBlock(b *block, bx, by, compIndex int) error {
+	// Skip blocks outside the MCUs that overlap the image bounds, and make
+	// bx and by relative to those MCUs.
+	hi, vi := d.comp[compIndex].h, d.comp[compIndex].v
+	if d.nComp == 1 {
+		hi, vi = 1, 1
+	}
+	bx -= hi * d.mcus.Min.X
+	by -= vi * d.mcus.Min.Y
+	if bx < 0 || by < 0 || bx >= hi*d.mcus.Dx() || by >= vi*d.mcus.Dy() {
+		return nil
+	}
+
 	qt := &d.quant[d.comp[compIndex].tq]
 	for zig := 0; zig < blockSize; zig++ {
 		b[unzig[zig]] *= qt[zig]
 	}
-	idct(b)
+	bd := d.blockDim
+	if bd == 8 {
+		idct(b)
+	} else {
+		scaledIDCT(b, bd)
+	}
 	dst, stride := []byte(nil), 0
 	if d.nComp == 1 {
-		dst, stride = d.img1.Pix[8*(by*d.img1.Stride+bx):], d.img1.Stride
+		dst, stride = d.img1.Pix[bd*(by*d.img1.Stride+bx):], d.img1.Stride
 	} else {
 		switch compIndex {
 		case 0:
-			dst, stride = d.img3.Y[8*(by*d.img3.YStride+bx):], d.img3.YStride
+			dst, stride = d.img3.Y[bd*(by*d.img3.YStride+bx):], d.img3.YStride
 		case 1:
-			dst, stride = d.img3.Cb[8*(by*d.img3.CStride+bx):], d.img3.CStride
+			dst, stride = d.img3.Cb[bd*(by*d.img3.CStride+bx):], d.img3.CStride
 		case 2:
-			dst, stride = d.img3.Cr[8*(by*d.img3.CStride+bx):], d.img3.CStride
+			dst, stride = d.img3.Cr[bd*(by*d.img3.CStride+bx):], d.img3.CStride
 		case 3:
-			dst, stride = d.blackPix[8*(by*d.blackStride+bx):], d.blackStride
+			dst, stride = d.blackPix[bd*(by*d.blackStride+bx):], d.blackStride
 		default:
 			return UnsupportedError("too many components")
 		}
 	}
 	// Level shift by +128, clip to [0, 255], and write to dst.
-	for y := 0; y < 8; y++ {
+	for y := 0; y < bd; y++ {
 		y8 := y * 8
 		yStride := y * stride
-		for x := 0; x < 8; x++ {
+		for x := 0; x < bd; x++ {
 			c := b[y8+x]
 			if c < -128 {
 				c = 0
@@ -543,6 +864,73 @@ func (d *decoder) reconstructBlock(b *block, bx, by, compIndex int) error {
 	return nil
 }
 
+// intervalOutside returns whether the restart interval starting at the
+// current MCU can be skipped over, because none of its MCUs overlap the
+// image bounds. This is only done for sequential Huffman-coded scans whose
+// MCUs are those of the image: all of the components, or grayscale.
+func (d *decoder) intervalOutside(s *scanState) bool {
+	if d.progressive || d.arithmetic || d.coeffsOnly || (s.nComp == 1 && d.nComp != 1) {
+		return false
+	}
+	crop := d.cropMCUs
+	first := s.mcu
+	last := min(s.mcu+d.ri, s.mxx*s.myy) - 1
+	for my := first / s.mxx; my <= last/s.mxx; my++ {
+		if my < crop.Min.Y || crop.Max.Y <= my {
+			continue
+		}
+		mx0, mx1 := 0, s.mxx-1
+		if my == first/s.mxx {
+			mx0 = first % s.mxx
+		}
+		if my == last/s.mxx {
+			mx1 = last % s.mxx
+		}
+		if mx0 < crop.Max.X && crop.Min.X <= mx1 {
+			return false
+		}
+	}
+	return true
+}
+
+// previewDone returns whether a progressive image has enough scans for a
+// preview, which is when every component has its DC coefficients.
+func (d *decoder) previewDone() bool {
+	if !d.opts.Preview || !d.progressive {
+		return false
+	}
+	for i := 0; i < d.nComp; i++ {
+		if d.progCoeffs[i] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// skipScan advances past a scan's entropy-coded data without decoding it,
+// leaving the next marker to be read again. If rst is false, RST[0-7]
+// markers are skipped over as part of the data.
+func (d *decoder) skipScan(rst bool) error {
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		if c != 0xff {
+			continue
+		}
+		for c == 0xff {
+			if c, err = d.readByte(); err != nil {
+				return err
+			}
+		}
+		if c != 0x00 && (rst || c < rst0Marker || rst7Marker < c) {
+			d.unreadMarker()
+			return nil
+		}
+	}
+}
+
 // findRST advances past the next RST restart marker that matches expectedRST.
 // Other than I/O errors, it is also an error if we encounter an {0xFF, M}
 // two-byte marker sequence where M is not 0x00, 0xFF or the expectedRST.
@@ -553,6 +941,7 @@ func (d *decoder) reconstructBlock(b *block, bx, by, compIndex int) error {
 // Precondition: d.tmp[:2] holds the next two bytes of JPEG-encoded input
 // (input in the d.readFull sense).
 func (d *decoder) findRST(expectedRST uint8) error {
+	start := d.offset() - 2
 	for {
 		// i is the index such that, at the bottom of the loop, we read 2-i
 		// bytes into d.tmp[i:2], maintaining the invariant that d.tmp[:2]
@@ -562,7 +951,7 @@ func (d *decoder) findRST(expectedRST uint8) error {
 
 		if d.tmp[0] == 0xff {
 			if d.tmp[1] == expectedRST {
-				return nil
+				return d.warn(ExtraneousData, start, d.offset()-2-start)
 			} else if d.tmp[1] == 0xff {
 				i = 1
 			} else if d.tmp[1] != 0x00 {
@@ -586,3 +975,105 @@ func (d *decoder) findRST(expectedRST uint8) error {
 		}
 	}
 }
+
+// resyncing returns whether restart markers are used to recover from corrupt
+// data. Arithmetic coded images are not resynchronized.
+func (d *decoder) resyncing() bool {
+	return d.opts.Resync && d.ri > 0 && !d.arithmetic
+}
+
+// isCorrupt returns whether err means that the entropy-coded data is corrupt,
+// as opposed to truncated.
+func isCorrupt(err error) bool {
+	fe, ok := err.(FormatError)
+	return ok && fe != errShortHuffmanData
+}
+
+// resyncRST is called when the restart marker at the end of a restart
+// interval is not the expected one. It finds the next marker and, depending
+// on how far that marker is from expectedRST, either skips past it and
+// resumes decoding, or leaves it to be read again and reports that the next
+// restart interval is missing.
+//
+// This is libjpeg's jdmarker.c's jpeg_resync_to_restart function.
+// https://github.com/libjpeg-turbo/libjpeg-turbo/blob/2dfe6c0fe9e18671105e94f7cbf044d4a1d157e6/jdmarker.c#L1295-L1344
+//
+// Precondition: d.tmp[:2] holds the next two bytes of JPEG-encoded input
+// (input in the d.readFull sense).
+func (d *decoder) resyncRST(expectedRST uint8) (missing bool, err error) {
+	for {
+		// Skip to the next marker, as per findRST.
+		for d.tmp[0] != 0xff || d.tmp[1] == 0x00 || d.tmp[1] == 0xff {
+			i := 0
+			if d.tmp[1] == 0xff {
+				d.tmp[0] = 0xff
+				i = 1
+			}
+			if err := d.readFull(d.tmp[i:2]); err != nil {
+				return false, err
+			}
+		}
+
+		marker := d.tmp[1]
+		switch distance := (marker - expectedRST) & 7; {
+		case marker < sof0Marker:
+			// Not a valid marker, so keep looking.
+		case marker < rst0Marker || rst7Marker < marker:
+			// A marker that isn't RST, such as EOI, means that the rest of
+			// the scan is missing. Leave it to be read again.
+			d.unreadMarker()
+			return true, nil
+		case distance == 1 || distance == 2:
+			// One of the next two restart markers means that the restart
+			// intervals before it are missing. Leave it to be read again.
+			d.unreadMarker()
+			return true, nil
+		case distance == 6 || distance == 7:
+			// One of the previous two restart markers means that we are
+			// behind, so keep looking.
+		default:
+			// Either the expected restart marker, or one too far away to
+			// reason about. Resume decoding after it.
+			return false, nil
+		}
+		if err := d.readFull(d.tmp[:2]); err != nil {
+			return false, err
+		}
+	}
+}
+
+// unreadMarker undoes the d.readFull call that read the two-byte marker in
+// d.tmp[:2]. The d.fill method keeps the last two bytes of the buffer, so
+// this is always possible.
+func (d *decoder) unreadMarker() {
+	d.bytes.i -= 2
+}
+
+// addDamage records that the pixels in r, clipped to the image bounds, were
+// decoded from missing or corrupt data. Adjacent regions are merged. The
+// rectangle r is in unscaled coordinates.
+func (d *decoder) addDamage(r image.Rectangle) {
+	if bd := d.blockDim; bd != 8 {
+		r.Min = r.Min.Mul(bd).Div(8)
+		r.Max = r.Max.Mul(bd).Add(image.Pt(7, 7)).Div(8)
+	}
+	r = r.Intersect(d.bounds)
+	if r.Empty() {
+		return
+	}
+	if n := len(d.damaged); n > 0 {
+		last := &d.damaged[n-1]
+		if r.In(*last) {
+			return
+		}
+		if last.Min.Y == r.Min.Y && last.Max.Y == r.Max.Y && last.Max.X >= r.Min.X && last.Min.X <= r.Min.X {
+			last.Max.X = max(last.Max.X, r.Max.X)
+			return
+		}
+		if last.Min.X == r.Min.X && last.Max.X == r.Max.X && last.Max.Y == r.Min.Y {
+			last.Max.Y = r.Max.Y
+			return
+		}
+	}
+	d.damaged = append(d.damaged, r)
+}
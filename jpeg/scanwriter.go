@@ -0,0 +1,405 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxCorrBits is the number of pending correction bits of a refinement scan
+// after which the end-of-band run is ended, as libjpeg does.
+const maxCorrBits = 1000 - blockSize + 1
+
+// defaultScans returns libjpeg's default progression of scans for an image
+// with nComp components. Its first scans are of the DC coefficients, and the
+// low frequency luminance coefficients, which give a recognizable image.
+func defaultScans(nComp int) []Scan {
+	var scans []Scan
+	dc := func(ah, al int) {
+		all := make([]int, nComp)
+		for i := range all {
+			all[i] = i
+		}
+		scans = append(scans, Scan{Components: all, ApproxHigh: ah, ApproxLow: al})
+	}
+	ac := func(i, ss, se, ah, al int) {
+		scans = append(scans, Scan{Components: []int{i}, SpectralStart: ss, SpectralEnd: se, ApproxHigh: ah, ApproxLow: al})
+	}
+	if nComp == 3 {
+		dc(0, 1)
+		ac(0, 1, 5, 0, 2)
+		ac(2, 1, 63, 0, 1)
+		ac(1, 1, 63, 0, 1)
+		ac(0, 6, 63, 0, 2)
+		ac(0, 1, 63, 2, 1)
+		dc(1, 0)
+		ac(2, 1, 63, 1, 0)
+		ac(1, 1, 63, 1, 0)
+		ac(0, 1, 63, 1, 0)
+		return scans
+	}
+	dc(0, 1)
+	for i := range nComp {
+		ac(i, 1, 5, 0, 2)
+	}
+	for i := range nComp {
+		ac(i, 6, 63, 0, 2)
+	}
+	for i := range nComp {
+		ac(i, 1, 63, 2, 1)
+	}
+	dc(1, 0)
+	for i := range nComp {
+		ac(i, 1, 63, 1, 0)
+	}
+	return scans
+}
+
+// checkScans checks that scans is a valid progression for an image with
+// nComp components, which sends every bit of every coefficient.
+func checkScans(scans []Scan, nComp int) error {
+	errInvalid := errors.New("jpeg: invalid progressive scans")
+	// al is the ApproxLow of the last scan of each coefficient of each
+	// component, or -1 if there has been none.
+	var al [maxComponents][blockSize]int
+	for i := range al {
+		for k := range al[i] {
+			al[i][k] = -1
+		}
+	}
+	for _, s := range scans {
+		n := len(s.Components)
+		if n == 0 || n > maxComponents || (n > 1 && s.SpectralStart != 0) {
+			return errInvalid
+		}
+		for j, i := range s.Components {
+			if i < 0 || i >= nComp || (j > 0 && i <= s.Components[j-1]) {
+				return errInvalid
+			}
+		}
+		if s.SpectralStart == 0 && s.SpectralEnd != 0 ||
+			s.SpectralStart > s.SpectralEnd || s.SpectralEnd >= blockSize ||
+			s.ApproxLow < 0 || s.ApproxLow > 13 ||
+			s.ApproxHigh != 0 && s.ApproxHigh != s.ApproxLow+1 {
+			return errInvalid
+		}
+		for _, i := range s.Components {
+			if s.SpectralStart > 0 && al[i][0] < 0 {
+				// The DC coefficients are sent first.
+				return errInvalid
+			}
+			for k := s.SpectralStart; k <= s.SpectralEnd; k++ {
+				if (s.ApproxHigh == 0 && al[i][k] >= 0) || (s.ApproxHigh != 0 && al[i][k] != s.ApproxHigh) {
+					return errInvalid
+				}
+				al[i][k] = s.ApproxLow
+			}
+		}
+	}
+	for i := range nComp {
+		for _, x := range al[i] {
+			if x != 0 {
+				return errInvalid
+			}
+		}
+	}
+	return nil
+}
+
+// Huffman coding has codes for DC deltas of up to 11 bits, and AC values of
+// up to 10 bits, which is as large as they are for 8-bit samples, as per
+// section F.1.2. They are deliberately the limits for arithmetic coding too,
+// so that any valid Coefficients can be written with either coder, and
+// because the arithmetic coder's statistics only go up to 15 bits.
+const (
+	maxDCDelta = 1<<11 - 1
+	maxAC      = 1<<10 - 1
+)
+
+// checkDC checks that the DC deltas that the scans of c code, which depend
+// on the order of the blocks in each scan and on the restart interval, fit
+// in 11 bits.
+func (c *Coefficients) checkDC(scans []Scan) error {
+	for k := range scans {
+		s := &scans[k]
+		if s.SpectralStart != 0 || s.ApproxHigh != 0 {
+			continue
+		}
+		var err error
+		var prevDC [maxComponents]int32
+		nMCU := 0
+		c.scanBlocks(s, func() {
+			if c.RestartInterval > 0 && nMCU%c.RestartInterval == 0 {
+				prevDC = [maxComponents]int32{}
+			}
+			nMCU++
+		}, func(i, bx, by int) {
+			cc := &c.Components[i]
+			n := by*cc.BlocksWide + bx
+			dc := cc.Blocks[n][0] >> s.ApproxLow
+			if delta := dc - prevDC[i]; err == nil && (delta < -maxDCDelta || delta > maxDCDelta) {
+				err = fmt.Errorf("jpeg: DC coefficient delta out of range in block %d of component %d", n, i)
+			}
+			prevDC[i] = dc
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeScan writes the scan s of the image c, as a DHT marker with Huffman
+// tables that are optimized for the scan, followed by the SOS marker and the
+// entropy-coded data. If c is arithmetic coded, there is no DHT marker, and
+// the default arithmetic conditioning is used.
+func (e *encoder) writeScan(c *Coefficients, s *Scan, progressive bool) {
+	if c.Arithmetic {
+		e.arith = &arithmeticEncoder{}
+		e.arith.reset()
+	} else {
+		// Count the Huffman-coded values by encoding the scan without
+		// writing it.
+		var counts [nHuffIndex][256]int
+		stats := encoder{w: bufio.NewWriter(io.Discard), ri: e.ri, counts: &counts}
+		stats.encodeScan(c, s, progressive)
+		var specs [nHuffIndex]huffmanSpec
+		var hs []huffIndex
+		for h := range counts {
+			if counts[h] != [256]int{} {
+				specs[h] = optimalHuffmanSpec(&counts[h])
+				e.huff[h].init(specs[h])
+				hs = append(hs, huffIndex(h))
+			}
+		}
+		if len(hs) > 0 {
+			e.writeHuffmanSpecs(hs, &specs)
+		}
+	}
+
+	n := len(s.Components)
+	e.writeMarkerHeader(sosMarker, 6+2*n)
+	e.writeByte(uint8(n))
+	for _, i := range s.Components {
+		e.writeByte(c.Components[i].ID)
+		// The first component uses the luminance Huffman tables, and the
+		// others use the chrominance ones, as Encode does.
+		e.writeByte("\x00\x11\x11\x11"[min(i, 1)])
+	}
+	e.writeByte(uint8(s.SpectralStart))
+	e.writeByte(uint8(s.SpectralEnd))
+	e.writeByte(uint8(s.ApproxHigh<<4 | s.ApproxLow))
+	e.encodeScan(c, s, progressive)
+	e.finishSOS()
+}
+
+// encodeScan emits the entropy-coded data of the scan s of the image c.
+func (e *encoder) encodeScan(c *Coefficients, s *Scan, progressive bool) {
+	e.prevDC = [maxComponents]int32{}
+	e.nMCU = 0
+	e.eobRun, e.corrBits = 0, e.corrBits[:0]
+	// acHuff is the AC Huffman encoder of a progressive AC scan, which only
+	// has one component.
+	acHuff := huffIndex(2*min(s.Components[0], 1) + 1)
+	emitBlock := func(i, bx, by int) {
+		cc := &c.Components[i]
+		z := block(cc.Blocks[by*cc.BlocksWide+bx])
+		if !c.ZigZag {
+			z = block(zigBlock(Block(z)))
+		}
+		h := huffIndex(2 * min(i, 1))
+		switch {
+		case e.arith != nil:
+			e.encodeArithmeticBlock(&z, i, s)
+		case !progressive:
+			e.prevDC[i] = e.emitBlock(&z, h, e.prevDC[i])
+		case s.SpectralStart == 0 && s.ApproxHigh == 0:
+			dc := z[0] >> s.ApproxLow
+			e.emitHuffRLE(h, 0, dc-e.prevDC[i])
+			e.prevDC[i] = dc
+		case s.SpectralStart == 0:
+			e.emit(uint32(z[0]>>s.ApproxLow)&1, 1)
+		case s.ApproxHigh == 0:
+			e.emitACFirst(&z, h+1, s)
+		default:
+			e.emitACRefine(&z, h+1, s)
+		}
+	}
+	// endInterval ends the entropy-coded data of a restart interval or of
+	// the scan.
+	endInterval := func() {
+		if e.arith != nil {
+			e.finishArithmetic()
+		} else {
+			e.emitEOBRun(acHuff)
+		}
+	}
+	startMCU := func() {
+		if e.ri > 0 && e.nMCU > 0 && e.nMCU%e.ri == 0 {
+			endInterval()
+		}
+		e.startMCU()
+	}
+
+	c.scanBlocks(s, startMCU, emitBlock)
+	endInterval()
+}
+
+// scanBlocks calls block with the component and position of each block of
+// the scan s of the image c, in the order that they are coded, and calls mcu
+// at the start of each MCU.
+func (c *Coefficients) scanBlocks(s *Scan, mcu func(), block func(i, bx, by int)) {
+	hMax, vMax := 1, 1
+	for _, cc := range c.Components {
+		hMax, vMax = max(hMax, cc.H), max(vMax, cc.V)
+	}
+	if len(s.Components) == 1 {
+		// Each MCU of a non-interleaved scan is a single block.
+		i := s.Components[0]
+		bw, bh := c.componentBlocks(i, hMax, vMax)
+		for by := 0; by < bh; by++ {
+			for bx := 0; bx < bw; bx++ {
+				mcu()
+				block(i, bx, by)
+			}
+		}
+		return
+	}
+	mxx := (c.Width + 8*hMax - 1) / (8 * hMax)
+	myy := (c.Height + 8*vMax - 1) / (8 * vMax)
+	for my := 0; my < myy; my++ {
+		for mx := 0; mx < mxx; mx++ {
+			mcu()
+			for _, i := range s.Components {
+				cc := &c.Components[i]
+				for j := 0; j < cc.H*cc.V; j++ {
+					block(i, cc.H*mx+j%cc.H, cc.V*my+j/cc.H)
+				}
+			}
+		}
+	}
+}
+
+// emitEOBRun emits the pending end-of-band run, if any, with the Huffman
+// encoder h, followed by the pending correction bits.
+func (e *encoder) emitEOBRun(h huffIndex) {
+	if e.eobRun > 0 {
+		// The run's length is 2**nBits plus its nBits low bits.
+		nBits := uint32(bitCount[e.eobRun&0xff]) - 1
+		if e.eobRun >= 0x100 {
+			nBits = 7 + uint32(bitCount[e.eobRun>>8])
+		}
+		e.emitHuff(h, int32(nBits<<4))
+		if nBits > 0 {
+			e.emit(uint32(e.eobRun)&(1<<nBits-1), nBits)
+		}
+		e.eobRun = 0
+	}
+	for _, b := range e.corrBits {
+		e.emit(uint32(b), 1)
+	}
+	e.corrBits = e.corrBits[:0]
+}
+
+// emitACFirst emits the first scan of the spectral band of s of the block z,
+// which is in zig-zag order, using the Huffman encoder h, as per section
+// G.1.2.2 of the spec.
+func (e *encoder) emitACFirst(z *block, h huffIndex, s *Scan) {
+	runLength := int32(0)
+	for k := s.SpectralStart; k <= s.SpectralEnd; k++ {
+		// The point transform divides by 2**Al, rounding towards zero.
+		ac := z[k]
+		if ac < 0 {
+			ac = -(-ac >> s.ApproxLow)
+		} else {
+			ac >>= s.ApproxLow
+		}
+		if ac == 0 {
+			runLength++
+			continue
+		}
+		e.emitEOBRun(h)
+		for runLength > 15 {
+			e.emitHuff(h, 0xf0)
+			runLength -= 16
+		}
+		e.emitHuffRLE(h, runLength, ac)
+		runLength = 0
+	}
+	if runLength > 0 {
+		e.eobRun++
+		if e.eobRun == 0x7fff {
+			e.emitEOBRun(h)
+		}
+	}
+}
+
+// emitACRefine emits a refinement scan of the spectral band of s of the block
+// z, which is in zig-zag order, using the Huffman encoder h, as per section
+// G.1.2.3 of the spec.
+func (e *encoder) emitACRefine(z *block, h huffIndex, s *Scan) {
+	// abs is the absolute values of the coefficients after the point
+	// transform, and eob is the index of the last one that is newly non-zero.
+	var abs [blockSize]int32
+	eob := 0
+	for k := s.SpectralStart; k <= s.SpectralEnd; k++ {
+		abs[k] = max(z[k], -z[k]) >> s.ApproxLow
+		if abs[k] == 1 {
+			eob = k
+		}
+	}
+	// corrBits is the correction bits of this block, which follow those of
+	// the pending end-of-band run.
+	pending := len(e.corrBits)
+	runLength := int32(0)
+	for k := s.SpectralStart; k <= s.SpectralEnd; k++ {
+		if abs[k] == 0 {
+			runLength++
+			continue
+		}
+		// Emit any zero runs that are not part of the end of band.
+		for runLength > 15 && k <= eob {
+			corrBits := e.corrBits[pending:]
+			e.corrBits = e.corrBits[:pending]
+			e.emitEOBRun(h)
+			e.emitHuff(h, 0xf0)
+			runLength -= 16
+			for _, b := range corrBits {
+				e.emit(uint32(b), 1)
+			}
+			e.corrBits, pending = e.corrBits[:0], 0
+		}
+		if abs[k] > 1 {
+			// The coefficient was already non-zero, so it has a correction
+			// bit.
+			e.corrBits = append(e.corrBits, uint8(abs[k]&1))
+			continue
+		}
+		// The coefficient is newly non-zero.
+		corrBits := e.corrBits[pending:]
+		e.corrBits = e.corrBits[:pending]
+		e.emitEOBRun(h)
+		e.emitHuff(h, runLength<<4|1)
+		sign := uint32(1)
+		if z[k] < 0 {
+			sign = 0
+		}
+		e.emit(sign, 1)
+		for _, b := range corrBits {
+			e.emit(uint32(b), 1)
+		}
+		e.corrBits, pending = e.corrBits[:0], 0
+		runLength = 0
+	}
+	if runLength > 0 || len(e.corrBits) > pending {
+		e.eobRun++
+		if e.eobRun == 0x7fff || len(e.corrBits) > maxCorrBits {
+			e.emitEOBRun(h)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"errors"
+	"io"
+	"iter"
+)
+
+// SegmentInfo is a marker of a JPEG file, and the segment that it starts, as
+// yielded by [Segments].
+type SegmentInfo struct {
+	// Segment is the marker code, and the contents of the segment after its
+	// length. The SOI, EOI and RST[0-7] markers have no segment.
+	Segment
+	// Offset is the offset of the marker in the input, and Length is the
+	// segment's length, which includes the 2 bytes of the length itself but
+	// not the marker. Length is zero for a marker without a segment.
+	Offset int64
+	Length int
+	// Scan is the entropy-coded data after an SOS segment, and ScanOffset
+	// is its offset in the input. It includes any RST[0-7] markers, and
+	// RSTOffsets is the offset of each of them in the input.
+	Scan       []byte
+	ScanOffset int64
+	RSTOffsets []int64
+}
+
+// errStopSegments stops decoding when the iteration of Segments stops.
+var errStopSegments = errors.New("jpeg: segment iteration stopped")
+
+// Segments returns an iterator over the markers of the JPEG file read from
+// r, from the SOI marker to the EOI marker, and the segments that they
+// start. Fill bytes and extraneous data between segments are skipped, as
+// Decode skips them. The segments are not decoded, so their contents need
+// not be valid. If the input is not a well-formed sequence of segments, the
+// iteration ends with the same error that [Decode] would return.
+func Segments(r io.Reader) iter.Seq2[*SegmentInfo, error] {
+	return func(yield func(*SegmentInfo, error) bool) {
+		d := decoder{
+			segmentFunc: func(s *SegmentInfo) error {
+				if !yield(s, nil) {
+					return errStopSegments
+				}
+				return nil
+			},
+		}
+		_, err := d.decode(r, false)
+		if err != nil && err != errStopSegments {
+			yield(nil, d.wrapError(err))
+		}
+	}
+}
+
+// processStandaloneMarker passes the marker that was just read, which has no
+// segment, to d.segmentFunc, if it is not nil.
+func (d *decoder) processStandaloneMarker(marker uint8) error {
+	if d.segmentFunc == nil {
+		return nil
+	}
+	return d.segmentFunc(&SegmentInfo{Segment: Segment{Marker: marker}, Offset: d.offset() - 2})
+}
+
+// processRawSegment reads a segment of n bytes after its length, along with
+// the entropy-coded data after it if it is an SOS segment, and passes it to
+// d.segmentFunc.
+func (d *decoder) processRawSegment(marker uint8, n int) error {
+	s := &SegmentInfo{
+		Segment: Segment{Marker: marker, Data: make([]byte, n)},
+		Offset:  d.offset() - 4,
+		Length:  n + 2,
+	}
+	if err := d.readFull(s.Data); err != nil {
+		return err
+	}
+	if marker == sosMarker {
+		if err := d.checkContext(); err != nil {
+			return err
+		}
+		s.ScanOffset = d.offset()
+		data, ends, err := d.readScanData()
+		if err != nil {
+			return err
+		}
+		for _, end := range ends[:len(ends)-1] {
+			s.RSTOffsets = append(s.RSTOffsets, s.ScanOffset+int64(end))
+		}
+		// Leave the marker after the scan to be read again.
+		s.Scan = data[:ends[len(ends)-1]]
+		d.unreadMarker()
+	}
+	return d.segmentFunc(s)
+}
@@ -0,0 +1,65 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"context"
+	"io"
+)
+
+// Tables is the quantization, Huffman and arithmetic conditioning tables of a
+// tables-only JPEG stream, as returned by [DecodeTables]. Formats such as
+// TIFF and DICOM, and some cameras, send them separately from abbreviated
+// images, which lack them. The [DecoderOptions] Tables option decodes such
+// images with them. Tables is not modified by decoding, so it can be shared
+// between decoders.
+type Tables struct {
+	huff        [maxTc + 1][maxTh + 1]huffman
+	arithDcCond [maxTb + 1]arithmeticDcConditioning
+	arithAcCond [maxTb + 1]arithmeticAcConditioning
+	quant       [maxTq + 1]block
+}
+
+// DecodeTables reads a tables-only JPEG stream from r, as specified in
+// section B.5: an SOI marker, table and miscellaneous segments, and an EOI
+// marker. It stops and returns ctx.Err() if ctx is done before the stream
+// is fully read. Errors are as for [DecodeContext]. Default parameters are
+// used if a nil *[DecoderOptions] is passed, and its Tables option, if any,
+// gives the tables that the stream does not replace.
+func DecodeTables(ctx context.Context, r io.Reader, o *DecoderOptions) (*Tables, error) {
+	d := decoder{ctx: ctx, tablesOnly: true}
+	if o != nil {
+		d.opts = *o
+	}
+	if _, err := d.decode(r, false); err != nil {
+		return nil, d.wrapError(err)
+	}
+	return &Tables{
+		huff:        d.huff,
+		arithDcCond: d.arithDcCond,
+		arithAcCond: d.arithAcCond,
+		quant:       d.quant,
+	}, nil
+}
+
+// EncodeTables writes the tables-only JPEG stream for the images that Encode
+// writes with the given options and the Abbreviated option: an SOI marker,
+// the quantization and Huffman tables for both luminance and chrominance,
+// and an EOI marker. Default parameters are used if a nil *[Options] is
+// passed.
+func EncodeTables(w io.Writer, o *Options) error {
+	var e encoder
+	if err := e.init(w, o); err != nil {
+		return err
+	}
+	// Write the Start Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd8
+	e.write(e.buf[:2])
+	e.writeDQT()
+	e.writeDHT(3)
+	e.writeEOI()
+	return e.err
+}
@@ -0,0 +1,47 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"context"
+	"io"
+)
+
+// TranscodeOptions are the parameters for Transcode.
+type TranscodeOptions struct {
+	// Progressive means that the image is written as a progressive JPEG,
+	// with libjpeg's default progression of scans, instead of a sequential
+	// one.
+	Progressive bool
+	// Arithmetic means that the image is arithmetic coded instead of Huffman
+	// coded.
+	Arithmetic bool
+	// Requantize, if not nil, means that the image is requantized, as
+	// Requantize does, which makes it smaller if the new quantization tables
+	// are coarser.
+	Requantize *RequantizeOptions
+}
+
+// Transcode reads a JPEG image from r and writes it to w as o specifies,
+// with the same quantized DCT coefficients, so that it decodes to the same
+// image, unless the Requantize option is set. The image's metadata is kept,
+// and if it is Huffman coded, its Huffman tables are optimized for it.
+// Default parameters are used if a nil *TranscodeOptions is passed.
+func Transcode(ctx context.Context, w io.Writer, r io.Reader, o *TranscodeOptions) error {
+	if o == nil {
+		o = &TranscodeOptions{}
+	}
+	c, err := DecodeCoefficients(ctx, r, &CoefficientOptions{Metadata: true})
+	if err != nil {
+		return err
+	}
+	if o.Requantize != nil {
+		if err := Requantize(c, o.Requantize); err != nil {
+			return err
+		}
+	}
+	c.Progressive, c.Arithmetic, c.Scans = o.Progressive, o.Arithmetic, nil
+	return EncodeCoefficients(w, c)
+}
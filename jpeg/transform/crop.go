@@ -0,0 +1,61 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package transform
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+
+	"github.com/robert-ancell/go-jpeg"
+)
+
+// CropJPEG reads a JPEG image from src, crops it to r, as Crop does, and
+// writes it to w. Only the Metadata option applies. Default parameters are
+// used if a nil *Options is passed.
+func CropJPEG(ctx context.Context, w io.Writer, src io.Reader, r image.Rectangle, o *Options) error {
+	c, err := decode(ctx, src, o)
+	if err != nil {
+		return err
+	}
+	if c, err = Crop(c, r); err != nil {
+		return err
+	}
+	return jpeg.EncodeCoefficients(w, c)
+}
+
+// Crop returns the coefficients of the part of the image c within r, which
+// must be a non-empty rectangle within the image's bounds, whose top left
+// corner is (0, 0). As only whole MCUs (Minimum Coded Units) can be moved,
+// the top left corner of r is moved up and left to the nearest MCU boundary,
+// like jpegtran's -crop option does, so the result may be larger than r. The
+// bottom right corner is kept, as the blocks along it can be partially
+// shown. The quantization tables are unchanged, so no quality is lost, and as
+// the image is re-encoded, the DC coefficients are predicted from the blocks
+// of the result. c is not modified.
+func Crop(c *jpeg.Coefficients, r image.Rectangle) (*jpeg.Coefficients, error) {
+	if r.Empty() || !r.In(image.Rect(0, 0, c.Width, c.Height)) {
+		return nil, errors.New("transform: crop rectangle is not within the image")
+	}
+	mw, mh := mcuSize(c)
+	mx, my := r.Min.X/mw, r.Min.Y/mh
+
+	t := *c
+	t.Width, t.Height = r.Max.X-mx*mw, r.Max.Y-my*mh
+	t.Components = make([]jpeg.ComponentCoefficients, len(c.Components))
+	for i := range c.Components {
+		src, dst := &c.Components[i], &t.Components[i]
+		dst.ID, dst.H, dst.V, dst.Quant = src.ID, src.H, src.V, src.Quant
+		hf, vf := blocksPerMCU(c, i)
+		dst.BlocksWide, dst.BlocksHigh = (t.Width+mw-1)/mw*hf, (t.Height+mh-1)/mh*vf
+		dst.Blocks = make([]jpeg.Block, dst.BlocksWide*dst.BlocksHigh)
+		for by := 0; by < dst.BlocksHigh; by++ {
+			i0 := (my*vf+by)*src.BlocksWide + mx*hf
+			copy(dst.Blocks[by*dst.BlocksWide:][:dst.BlocksWide], src.Blocks[i0:])
+		}
+	}
+	return &t, nil
+}
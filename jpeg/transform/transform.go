@@ -0,0 +1,224 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package transform implements lossless transformations of JPEG images, like
+// those of jpegtran. The images are transformed by rearranging their
+// quantized DCT coefficients, so they are not decoded and re-encoded, and
+// their quality is not reduced.
+package transform
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/robert-ancell/go-jpeg"
+)
+
+// An Op is a transformation of an image.
+type Op int
+
+const (
+	// None leaves the image as it is.
+	None Op = iota
+	// FlipHorizontal mirrors the image left to right.
+	FlipHorizontal
+	// FlipVertical mirrors the image top to bottom.
+	FlipVertical
+	// Transpose mirrors the image across the diagonal from its top left
+	// corner.
+	Transpose
+	// Transverse mirrors the image across the diagonal from its top right
+	// corner.
+	Transverse
+	// Rotate90 rotates the image 90 degrees clockwise.
+	Rotate90
+	// Rotate180 rotates the image 180 degrees.
+	Rotate180
+	// Rotate270 rotates the image 270 degrees clockwise.
+	Rotate270
+)
+
+// parts returns how op is done: a transpose, if transpose is set, followed
+// by mirroring the result horizontally, if flipX is set, and vertically, if
+// flipY is set.
+func (op Op) parts() (transpose, flipX, flipY bool) {
+	switch op {
+	case FlipHorizontal:
+		return false, true, false
+	case FlipVertical:
+		return false, false, true
+	case Transpose:
+		return true, false, false
+	case Transverse:
+		return true, true, true
+	case Rotate90:
+		return true, true, false
+	case Rotate180:
+		return false, true, true
+	case Rotate270:
+		return true, false, true
+	}
+	return false, false, false
+}
+
+// Options are the transformation parameters.
+//
+// An image can only be mirrored in whole MCUs (Minimum Coded Units), which
+// are 8, 16 or 32 pixels across and down. When an edge that is mirrored is
+// not a whole number of MCUs from the opposite edge, the partial MCUs along
+// it are left where they are, untransformed except for any transpose. This is
+// what jpegtran does by default.
+type Options struct {
+	// Trim removes the partial MCUs along edges that are mirrored, as
+	// jpegtran's -trim option does, unless the image is smaller than an MCU.
+	Trim bool
+	// Perfect makes it an error for the image to have partial MCUs along an
+	// edge that is mirrored, as jpegtran's -perfect option does. It takes
+	// precedence over Trim.
+	Perfect bool
+	// Metadata keeps the image's APPn and COM segments, such as Exif
+	// metadata, when it is rewritten. They are not changed, so Exif
+	// dimensions and orientation are not updated.
+	Metadata bool
+}
+
+// Transform reads a JPEG image from r, transforms it by op and writes it to
+// w. The image is written by [jpeg.EncodeCoefficients], so only the parts of
+// it that it keeps are kept. Default parameters are used if a nil *Options is
+// passed.
+func Transform(ctx context.Context, w io.Writer, r io.Reader, op Op, o *Options) error {
+	c, err := decode(ctx, r, o)
+	if err != nil {
+		return err
+	}
+	if c, err = Apply(c, op, o); err != nil {
+		return err
+	}
+	return jpeg.EncodeCoefficients(w, c)
+}
+
+// Apply returns the coefficients of the image c transformed by op. The
+// blocks and quantization tables of c must be in natural order. c is not
+// modified. Default parameters are used if a nil *Options is passed.
+func Apply(c *jpeg.Coefficients, op Op, o *Options) (*jpeg.Coefficients, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	if op < None || op > Rotate270 {
+		return nil, errors.New("transform: invalid Op")
+	}
+	if c.ZigZag {
+		return nil, errors.New("transform: coefficients are in zig-zag order")
+	}
+	transpose, flipX, flipY := op.parts()
+
+	// The MCU size, in pixels, and the image size are those of the output.
+	mw, mh := mcuSize(c)
+	w, h := c.Width, c.Height
+	if transpose {
+		mw, mh, w, h = mh, mw, h, w
+	}
+	if o.Perfect && ((flipX && w%mw != 0) || (flipY && h%mh != 0)) {
+		return nil, errors.New("transform: image has partial MCUs along an edge that is mirrored")
+	}
+	if o.Trim {
+		if flipX && w > mw {
+			w -= w % mw
+		}
+		if flipY && h > mh {
+			h -= h % mh
+		}
+	}
+
+	t := *c
+	t.Width, t.Height = w, h
+	t.Components = make([]jpeg.ComponentCoefficients, len(c.Components))
+	for i := range c.Components {
+		src, dst := &c.Components[i], &t.Components[i]
+		dst.ID, dst.H, dst.V, dst.Quant = src.ID, src.H, src.V, src.Quant
+		if transpose {
+			dst.H, dst.V = src.V, src.H
+			dst.Quant = transformBlock(&src.Quant, true, false, false)
+		}
+		hf, vf := blocksPerMCU(&t, i)
+		dst.BlocksWide, dst.BlocksHigh = (w+mw-1)/mw*hf, (h+mh-1)/mh*vf
+		// fullX and fullY are the number of blocks across and down in whole
+		// MCUs, which are the ones that are mirrored.
+		fullX, fullY := w/mw*hf, h/mh*vf
+		dst.Blocks = make([]jpeg.Block, dst.BlocksWide*dst.BlocksHigh)
+		for by := 0; by < dst.BlocksHigh; by++ {
+			for bx := 0; bx < dst.BlocksWide; bx++ {
+				// (x, y) is the block before mirroring, and (sx, sy) is the
+				// source block.
+				x, y := bx, by
+				mirrorX, mirrorY := flipX && bx < fullX, flipY && by < fullY
+				if mirrorX {
+					x = fullX - 1 - bx
+				}
+				if mirrorY {
+					y = fullY - 1 - by
+				}
+				sx, sy := x, y
+				if transpose {
+					sx, sy = y, x
+				}
+				if sx >= src.BlocksWide || sy >= src.BlocksHigh {
+					continue
+				}
+				b := &src.Blocks[sy*src.BlocksWide+sx]
+				dst.Blocks[by*dst.BlocksWide+bx] = transformBlock(b, transpose, mirrorX, mirrorY)
+			}
+		}
+	}
+	return &t, nil
+}
+
+// transformBlock returns the block b transposed, if transpose is set, and
+// then mirrored horizontally and vertically, if flipX and flipY are set.
+// Mirroring a block negates the coefficients of the odd horizontal or
+// vertical frequencies.
+func transformBlock(b *jpeg.Block, transpose, flipX, flipY bool) (t jpeg.Block) {
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			x := b[8*v+u]
+			if transpose {
+				x = b[8*u+v]
+			}
+			if (flipX && u%2 == 1) != (flipY && v%2 == 1) {
+				x = -x
+			}
+			t[8*v+u] = x
+		}
+	}
+	return t
+}
+
+// decode reads the coefficients of a JPEG image from r, and its metadata if
+// the Metadata option is set.
+func decode(ctx context.Context, r io.Reader, o *Options) (*jpeg.Coefficients, error) {
+	return jpeg.DecodeCoefficients(ctx, r, &jpeg.CoefficientOptions{Metadata: o != nil && o.Metadata})
+}
+
+// mcuSize returns the width and height of the MCUs of c, in pixels. The MCU
+// of a single component is one block, whatever its sampling factors.
+func mcuSize(c *jpeg.Coefficients) (mw, mh int) {
+	if len(c.Components) == 1 {
+		return 8, 8
+	}
+	hMax, vMax := 1, 1
+	for _, cc := range c.Components {
+		hMax, vMax = max(hMax, cc.H), max(vMax, cc.V)
+	}
+	return 8 * hMax, 8 * vMax
+}
+
+// blocksPerMCU returns the number of blocks across and down that the i'th
+// component of c has in each MCU.
+func blocksPerMCU(c *jpeg.Coefficients, i int) (hf, vf int) {
+	if len(c.Components) == 1 {
+		return 1, 1
+	}
+	return c.Components[i].H, c.Components[i].V
+}
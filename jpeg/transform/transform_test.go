@@ -0,0 +1,296 @@
+// Copyright 2026 Robert Ancell. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package transform
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/robert-ancell/go-jpeg"
+)
+
+var testFiles = []string{
+	"../../testdata/video-001",
+	"../../testdata/video-001.q50.420",
+	"../../testdata/video-001.q50.422.progressive",
+	"../../testdata/video-001.cmyk",
+	"../../testdata/video-005.gray.q50",
+}
+
+func decodeCoefficients(t *testing.T, filename string) *jpeg.Coefficients {
+	t.Helper()
+	data, err := os.ReadFile(filename + ".jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := jpeg.DecodeCoefficients(context.Background(), bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func readImage(t *testing.T, filename string) ([]byte, image.Image) {
+	t.Helper()
+	data, err := os.ReadFile(filename + ".jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, m
+}
+
+// checkPixels compares each pixel of got with the pixel of want that at maps
+// it to, allowing their samples to differ by up to tolerance.
+func checkPixels(got, want image.Image, at func(x, y int) (int, int), tolerance int) error {
+	b := got.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			wx, wy := at(x, y)
+			if d := delta(got.At(x, y), want.At(wx, wy)); d > tolerance {
+				return fmt.Errorf("pixel (%d, %d) differs from (%d, %d) by %d", x, y, wx, wy, d)
+			}
+		}
+	}
+	return nil
+}
+
+func apply(t *testing.T, c *jpeg.Coefficients, o *Options, ops ...Op) *jpeg.Coefficients {
+	t.Helper()
+	for _, op := range ops {
+		var err error
+		if c, err = Apply(c, op, o); err != nil {
+			t.Fatalf("Apply(%d): %v", op, err)
+		}
+	}
+	return c
+}
+
+func TestCompose(t *testing.T) {
+	trim := &Options{Trim: true}
+	// Transposing 4:1:0 gives a subsampling ratio that Decode does not
+	// support, so that is only tested here.
+	for _, filename := range append(testFiles, "../../testdata/video-001.q50.410") {
+		// Remove the partial MCUs, so that the ops can be reversed.
+		c := apply(t, decodeCoefficients(t, filename), trim, Rotate180, Rotate180)
+		for _, tc := range []struct {
+			ops, equivalent []Op
+		}{
+			{[]Op{FlipHorizontal, FlipHorizontal}, []Op{None}},
+			{[]Op{FlipVertical, FlipVertical}, []Op{None}},
+			{[]Op{Transpose, Transpose}, []Op{None}},
+			{[]Op{Rotate90, Rotate90, Rotate90, Rotate90}, []Op{None}},
+			{[]Op{Rotate90, Rotate270}, []Op{None}},
+			{[]Op{Rotate90, Rotate90}, []Op{Rotate180}},
+			{[]Op{FlipHorizontal, FlipVertical}, []Op{Rotate180}},
+			{[]Op{Transpose, FlipHorizontal}, []Op{Rotate90}},
+			{[]Op{Transpose, FlipVertical}, []Op{Rotate270}},
+			{[]Op{Transpose, Rotate180}, []Op{Transverse}},
+		} {
+			got := apply(t, c, trim, tc.ops...)
+			want := apply(t, c, trim, tc.equivalent...)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %v is not equivalent to %v", filename, tc.ops, tc.equivalent)
+			}
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	for _, filename := range testFiles {
+		data, m := readImage(t, filename)
+		for op := None; op <= Rotate270; op++ {
+			var buf bytes.Buffer
+			if err := Transform(context.Background(), &buf, bytes.NewReader(data), op, &Options{Trim: true}); err != nil {
+				t.Fatalf("%s, %d: %v", filename, op, err)
+			}
+			got, err := jpeg.Decode(&buf)
+			if err != nil {
+				t.Fatalf("%s, %d: Decode: %v", filename, op, err)
+			}
+			// The inverse DCT is not exactly symmetric, so the samples may
+			// differ by rounding.
+			b := got.Bounds()
+			transpose, flipX, flipY := op.parts()
+			at := func(x, y int) (int, int) {
+				sx, sy := x, y
+				if flipX {
+					sx = b.Dx() - 1 - x
+				}
+				if flipY {
+					sy = b.Dy() - 1 - y
+				}
+				if transpose {
+					sx, sy = sy, sx
+				}
+				return sx, sy
+			}
+			if err := checkPixels(got, m, at, 1); err != nil {
+				t.Errorf("%s, %d: %v", filename, op, err)
+			}
+		}
+	}
+}
+
+// delta returns the largest difference between the samples of two colors of
+// the same type.
+func delta(c0, c1 color.Color) int {
+	var s0, s1 []uint8
+	switch c0 := c0.(type) {
+	case color.Gray:
+		c1 := c1.(color.Gray)
+		s0, s1 = []uint8{c0.Y}, []uint8{c1.Y}
+	case color.YCbCr:
+		c1 := c1.(color.YCbCr)
+		s0, s1 = []uint8{c0.Y, c0.Cb, c0.Cr}, []uint8{c1.Y, c1.Cb, c1.Cr}
+	case color.CMYK:
+		c1 := c1.(color.CMYK)
+		s0, s1 = []uint8{c0.C, c0.M, c0.Y, c0.K}, []uint8{c1.C, c1.M, c1.Y, c1.K}
+	}
+	d := 0
+	for i := range s0 {
+		d = max(d, int(s0[i])-int(s1[i]), int(s1[i])-int(s0[i]))
+	}
+	return d
+}
+
+func TestPartialMCUs(t *testing.T) {
+	// The 150x103 image has 16x16 MCUs.
+	c := decodeCoefficients(t, "../../testdata/video-001.q50.420")
+	for _, tc := range []struct {
+		op            Op
+		o             Options
+		width, height int
+		err           bool
+	}{
+		{FlipHorizontal, Options{}, 150, 103, false},
+		{FlipHorizontal, Options{Trim: true}, 144, 103, false},
+		{FlipHorizontal, Options{Perfect: true}, 0, 0, true},
+		{Rotate90, Options{Trim: true}, 96, 150, false},
+		{Rotate270, Options{Trim: true}, 103, 144, false},
+		{Rotate180, Options{Trim: true}, 144, 96, false},
+		{Transpose, Options{Perfect: true}, 103, 150, false},
+	} {
+		got, err := Apply(c, tc.op, &tc.o)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%d, %+v: got nil error", tc.op, tc.o)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d, %+v: %v", tc.op, tc.o, err)
+			continue
+		}
+		if got.Width != tc.width || got.Height != tc.height {
+			t.Errorf("%d, %+v: got size %dx%d, want %dx%d", tc.op, tc.o, got.Width, got.Height, tc.width, tc.height)
+		}
+	}
+
+	// Without Trim, the partial MCUs are left where they are.
+	got := apply(t, c, nil, FlipHorizontal)
+	for i, cc := range got.Components {
+		src := c.Components[i]
+		full := 150 / 16 * cc.H
+		for by := 0; by < cc.BlocksHigh; by++ {
+			for bx := full; bx < cc.BlocksWide; bx++ {
+				if cc.Blocks[by*cc.BlocksWide+bx] != src.Blocks[by*src.BlocksWide+bx] {
+					t.Fatalf("component %d: block (%d, %d) was moved", i, bx, by)
+				}
+			}
+		}
+	}
+
+	if _, err := Apply(c, Rotate270+1, nil); err == nil {
+		t.Error("got nil error for an invalid Op")
+	}
+	if _, err := Apply(&jpeg.Coefficients{ZigZag: true}, None, nil); err == nil {
+		t.Error("got nil error for zig-zag order")
+	}
+}
+
+func TestCrop(t *testing.T) {
+	for _, filename := range testFiles {
+		data, m := readImage(t, filename)
+		mw, mh := mcuSize(decodeCoefficients(t, filename))
+		for _, r := range []image.Rectangle{
+			image.Rect(0, 0, 150, 103),
+			image.Rect(0, 0, 1, 1),
+			image.Rect(40, 33, 150, 103),
+			image.Rect(17, 50, 99, 51),
+		} {
+			var buf bytes.Buffer
+			if err := CropJPEG(context.Background(), &buf, bytes.NewReader(data), r, nil); err != nil {
+				t.Fatalf("%s, %v: %v", filename, r, err)
+			}
+			got, err := jpeg.Decode(&buf)
+			if err != nil {
+				t.Fatalf("%s, %v: Decode: %v", filename, r, err)
+			}
+			// The crop starts at an MCU boundary, and the blocks are the
+			// same, so the pixels are too.
+			x0, y0 := r.Min.X-r.Min.X%mw, r.Min.Y-r.Min.Y%mh
+			if want := image.Rect(0, 0, r.Max.X-x0, r.Max.Y-y0); got.Bounds() != want {
+				t.Fatalf("%s, %v: got bounds %v, want %v", filename, r, got.Bounds(), want)
+			}
+			at := func(x, y int) (int, int) { return x0 + x, y0 + y }
+			if err := checkPixels(got, m, at, 0); err != nil {
+				t.Errorf("%s, %v: %v", filename, r, err)
+			}
+		}
+	}
+
+	c := decodeCoefficients(t, "../../testdata/video-001")
+	for _, r := range []image.Rectangle{
+		image.Rect(0, 0, 0, 0),
+		image.Rect(-1, 0, 10, 10),
+		image.Rect(0, 0, 151, 103),
+	} {
+		if _, err := Crop(c, r); err == nil {
+			t.Errorf("%v: got nil error", r)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	data, err := os.ReadFile("../../testdata/video-001.cmyk.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := jpeg.DecodeCoefficients(context.Background(), bytes.NewReader(data), &jpeg.CoefficientOptions{Metadata: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want.Metadata) == 0 {
+		t.Fatal("no metadata")
+	}
+	for _, o := range []*Options{nil, {Metadata: true}} {
+		var buf bytes.Buffer
+		if err := Transform(context.Background(), &buf, bytes.NewReader(data), Rotate180, o); err != nil {
+			t.Fatal(err)
+		}
+		got, err := jpeg.DecodeCoefficients(context.Background(), &buf, &jpeg.CoefficientOptions{Metadata: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o == nil && got.Metadata != nil {
+			t.Errorf("got metadata %v, want none", got.Metadata)
+		} else if o != nil && !reflect.DeepEqual(got.Metadata, want.Metadata) {
+			t.Errorf("got metadata %v, want %v", got.Metadata, want.Metadata)
+		}
+		if got.AdobeTransform != want.AdobeTransform {
+			t.Errorf("got Adobe transform %d, want %d", got.AdobeTransform, want.AdobeTransform)
+		}
+	}
+}
@@ -207,6 +207,99 @@ func init() {
 	}
 }
 
+// optimalHuffmanSpec returns the Huffman encoding specification with the
+// shortest codes for values with the given counts, as per section K.2 of the
+// spec. Codes are limited to 16 bits, and no code is all 1 bits.
+func optimalHuffmanSpec(counts *[256]int) huffmanSpec {
+	// freq has an extra value, 256, that reserves the all 1 bits code.
+	var freq [257]int
+	copy(freq[:], counts[:])
+	freq[256] = 1
+	if *counts == [256]int{} {
+		// A table needs at least one code.
+		freq[0] = 1
+	}
+	var codeSize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		// Find the values with the two smallest non-zero frequencies,
+		// preferring the larger value when they are tied.
+		c1, c2 := -1, -1
+		for i, f := range freq {
+			if f == 0 {
+				continue
+			}
+			if c1 < 0 || f <= freq[c1] {
+				c1, c2 = i, c1
+			} else if c2 < 0 || f <= freq[c2] {
+				c2 = i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		// Merge the two trees.
+		freq[c1] += freq[c2]
+		freq[c2] = 0
+		codeSize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codeSize[c1]++
+		}
+		others[c1] = c2
+		codeSize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codeSize[c2]++
+		}
+	}
+
+	// Count the codes of each size, and shorten any that are too long.
+	var nCodes [len(freq) + 1]int
+	maxSize := 0
+	for _, size := range codeSize {
+		if size > 0 {
+			nCodes[size]++
+			maxSize = max(maxSize, size)
+		}
+	}
+	for i := maxSize; i > 16; i-- {
+		for nCodes[i] > 0 {
+			j := i - 2
+			for nCodes[j] == 0 {
+				j--
+			}
+			nCodes[i] -= 2
+			nCodes[i-1]++
+			nCodes[j+1] += 2
+			nCodes[j]--
+		}
+	}
+	// Remove the reserved code, which is one of the longest.
+	for i := 16; i > 0; i-- {
+		if nCodes[i] > 0 {
+			nCodes[i]--
+			break
+		}
+	}
+
+	var s huffmanSpec
+	for i := range s.count {
+		s.count[i] = byte(nCodes[i+1])
+	}
+	for size := 1; size <= maxSize; size++ {
+		for v := range 256 {
+			if codeSize[v] == size {
+				s.value = append(s.value, byte(v))
+			}
+		}
+	}
+	return s
+}
+
 // writer is a buffered writer.
 type writer interface {
 	Flush() error
@@ -224,8 +317,33 @@ type encoder struct {
 	buf [16]byte
 	// bits and nBits are accumulated bits to write to w.
 	bits, nBits uint32
-	// quant is the scaled quantization tables, in zig-zag order.
-	quant [nQuantIndex][blockSize]byte
+	// quant is the scaled quantization tables, in zig-zag order, and nQuant
+	// is the number of them.
+	quant  [maxTq + 1][blockSize]uint16
+	nQuant int
+	// DC components are delta-encoded, so prevDC is the previous DC
+	// component of each image component.
+	prevDC [maxComponents]int32
+	// ri is the restart interval, in MCUs, or zero for no RST markers.
+	// nMCU is the number of MCUs written so far in the scan.
+	ri, nMCU int
+	// workers is the Workers option, and abbreviated is the Abbreviated
+	// option.
+	workers     int
+	abbreviated bool
+	// huff is the Huffman encoders, which are theHuffmanLUT unless they are
+	// optimized for the image. If counts is not nil, the values that would
+	// be emitted with each Huffman encoder are counted in it instead.
+	huff   [nHuffIndex]huffmanLUT
+	counts *[nHuffIndex][256]int
+	// eobRun is the number of blocks in the pending end-of-band run of a
+	// progressive AC scan, and corrBits is the correction bits of a
+	// refinement scan that are to be emitted after it.
+	eobRun   int
+	corrBits []uint8
+	// arith is the arithmetic encoder, if the scan is arithmetic coded
+	// rather than Huffman coded.
+	arith *arithmeticEncoder
 }
 
 func (e *encoder) flush() {
@@ -269,7 +387,11 @@ func (e *encoder) emit(bits, nBits uint32) {
 
 // emitHuff emits the given value with the given Huffman encoder.
 func (e *encoder) emitHuff(h huffIndex, value int32) {
-	x := theHuffmanLUT[h][value]
+	if e.counts != nil {
+		e.counts[h][value]++
+		return
+	}
+	x := e.huff[h][value]
 	e.emit(x&(1<<24-1), x>>24)
 }
 
@@ -301,14 +423,39 @@ func (e *encoder) writeMarkerHeader(marker uint8, markerlen int) {
 	e.write(e.buf[:4])
 }
 
-// writeDQT writes the Define Quantization Table marker.
+// writeDQT writes the Define Quantization Table marker. Tables with values
+// above 255 are written with 16-bit precision.
 func (e *encoder) writeDQT() {
-	const markerlen = 2 + int(nQuantIndex)*(1+blockSize)
+	markerlen := 2
+	for i := range e.nQuant {
+		markerlen += 1 + blockSize*quantPrecision(&e.quant[i])
+	}
 	e.writeMarkerHeader(dqtMarker, markerlen)
-	for i := range e.quant {
-		e.writeByte(uint8(i))
-		e.write(e.quant[i][:])
+	for i := range e.nQuant {
+		q := &e.quant[i]
+		if quantPrecision(q) == 1 {
+			e.writeByte(uint8(i))
+			for _, x := range q {
+				e.writeByte(uint8(x))
+			}
+		} else {
+			e.writeByte(0x10 | uint8(i))
+			for _, x := range q {
+				e.writeByte(uint8(x >> 8))
+				e.writeByte(uint8(x))
+			}
+		}
+	}
+}
+
+// quantPrecision returns the number of bytes needed for each value of q.
+func quantPrecision(q *[blockSize]uint16) int {
+	for _, x := range q {
+		if x > 255 {
+			return 2
+		}
 	}
+	return 1
 }
 
 // writeSOF0 writes the Start Of Frame (Baseline Sequential) marker.
@@ -339,35 +486,61 @@ func (e *encoder) writeSOF0(size image.Point, nComponent int) {
 
 // writeDHT writes the Define Huffman Table marker.
 func (e *encoder) writeDHT(nComponent int) {
-	markerlen := 2
-	specs := theHuffmanSpec[:]
+	hs := []huffIndex{huffIndexLuminanceDC, huffIndexLuminanceAC, huffIndexChrominanceDC, huffIndexChrominanceAC}
 	if nComponent == 1 {
 		// Drop the Chrominance tables.
-		specs = specs[:2]
+		hs = hs[:2]
 	}
-	for _, s := range specs {
-		markerlen += 1 + 16 + len(s.value)
+	e.writeHuffmanSpecs(hs, &theHuffmanSpec)
+}
+
+// writeHuffmanSpecs writes a Define Huffman Table marker for the Huffman
+// encoders hs, whose specifications are in specs.
+func (e *encoder) writeHuffmanSpecs(hs []huffIndex, specs *[nHuffIndex]huffmanSpec) {
+	markerlen := 2
+	for _, h := range hs {
+		markerlen += 1 + 16 + len(specs[h].value)
 	}
 	e.writeMarkerHeader(dhtMarker, markerlen)
-	for i, s := range specs {
-		e.writeByte("\x00\x10\x01\x11"[i])
-		e.write(s.count[:])
-		e.write(s.value)
+	for _, h := range hs {
+		e.writeByte("\x00\x10\x01\x11"[h])
+		e.write(specs[h].count[:])
+		e.write(specs[h].value)
 	}
 }
 
+// writeDRI writes the Define Restart Interval marker.
+func (e *encoder) writeDRI() {
+	e.writeMarkerHeader(driMarker, 4)
+	e.buf[0] = uint8(e.ri >> 8)
+	e.buf[1] = uint8(e.ri & 0xff)
+	e.write(e.buf[:2])
+}
+
 // writeBlock writes a block of pixel data using the given quantization table,
 // returning the post-quantized DC value of the DCT-transformed block. b is in
 // natural (not zig-zag) order.
 func (e *encoder) writeBlock(b *block, q quantIndex, prevDC int32) int32 {
 	fdct(b)
+	// Quantize the coefficients, in zig-zag order.
+	var z block
+	for zig := 0; zig < blockSize; zig++ {
+		z[zig] = div(b[unzig[zig]], 8*int32(e.quant[q][zig]))
+	}
+	return e.emitBlock(&z, huffIndex(2*q), prevDC)
+}
+
+// emitBlock emits a block of quantized coefficients, in zig-zag order, using
+// the DC Huffman encoder h and the AC Huffman encoder h+1, returning the DC
+// value.
+func (e *encoder) emitBlock(z *block, h huffIndex, prevDC int32) int32 {
 	// Emit the DC delta.
-	dc := div(b[0], 8*int32(e.quant[q][0]))
-	e.emitHuffRLE(huffIndex(2*q+0), 0, dc-prevDC)
+	dc := z[0]
+	e.emitHuffRLE(h, 0, dc-prevDC)
 	// Emit the AC components.
-	h, runLength := huffIndex(2*q+1), int32(0)
+	h, runLength := h+1, int32(0)
 	for zig := 1; zig < blockSize; zig++ {
-		ac := div(b[unzig[zig]], 8*int32(e.quant[q][zig]))
+		ac := z[zig]
 		if ac == 0 {
 			runLength++
 		} else {
@@ -507,58 +680,122 @@ var sosHeaderYCbCr = []byte{
 
 // writeSOS writes the StartOfScan marker.
 func (e *encoder) writeSOS(m image.Image) {
-	switch m.(type) {
-	case *image.Gray:
+	_, gray := m.(*image.Gray)
+	e.writeSOSHeader(gray)
+	if e.workers > 1 && e.ri > 0 {
+		e.writeIntervals(m)
+	} else {
+		bounds := m.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y += mcuSize(m) {
+			e.writeMCURow(m, y)
+		}
+	}
+	e.finishSOS()
+}
+
+// writeSOSHeader writes the StartOfScan marker header, for a grayscale or
+// a YCbCr image, and resets the delta-encoded DC components.
+func (e *encoder) writeSOSHeader(gray bool) {
+	if gray {
 		e.write(sosHeaderY)
-	default:
+	} else {
 		e.write(sosHeaderYCbCr)
 	}
+	e.prevDC = [maxComponents]int32{}
+	e.nMCU = 0
+}
+
+// mcuSize returns the width and height of an MCU when encoding m: 8 pixels
+// for an *image.Gray, and 16 otherwise.
+func mcuSize(m image.Image) int {
+	if _, ok := m.(*image.Gray); ok {
+		return 8
+	}
+	return 16
+}
+
+// writeMCURow writes the row of MCUs whose top edge is y. Pixels beyond m's
+// bounds replicate those at its edges.
+func (e *encoder) writeMCURow(m image.Image, y int) {
+	size := mcuSize(m)
+	e.writeMCUs(m, y, 0, (m.Bounds().Dx()+size-1)/size)
+}
+
+// writeMCUs writes the MCUs from column mx0 up to mx1 of the row of MCUs
+// whose top edge is y. A RST marker is written before each MCU that starts
+// a restart interval, other than the first.
+func (e *encoder) writeMCUs(m image.Image, y, mx0, mx1 int) {
 	var (
 		// Scratch buffers to hold the YCbCr values.
 		// The blocks are in natural (not zig-zag) order.
 		b      block
 		cb, cr [4]block
-		// DC components are delta-encoded.
-		prevDCY, prevDCCb, prevDCCr int32
 	)
 	bounds := m.Bounds()
-	switch m := m.(type) {
-	// TODO(wathiede): switch on m.ColorModel() instead of type.
-	case *image.Gray:
-		for y := bounds.Min.Y; y < bounds.Max.Y; y += 8 {
-			for x := bounds.Min.X; x < bounds.Max.X; x += 8 {
-				p := image.Pt(x, y)
-				grayToY(m, p, &b)
-				prevDCY = e.writeBlock(&b, 0, prevDCY)
-			}
-		}
-	default:
-		rgba, _ := m.(*image.RGBA)
-		ycbcr, _ := m.(*image.YCbCr)
-		for y := bounds.Min.Y; y < bounds.Max.Y; y += 16 {
-			for x := bounds.Min.X; x < bounds.Max.X; x += 16 {
-				for i := 0; i < 4; i++ {
-					xOff := (i & 1) * 8
-					yOff := (i & 2) * 4
-					p := image.Pt(x+xOff, y+yOff)
-					if rgba != nil {
-						rgbaToYCbCr(rgba, p, &b, &cb[i], &cr[i])
-					} else if ycbcr != nil {
-						yCbCrToYCbCr(ycbcr, p, &b, &cb[i], &cr[i])
-					} else {
-						toYCbCr(m, p, &b, &cb[i], &cr[i])
-					}
-					prevDCY = e.writeBlock(&b, 0, prevDCY)
+	size := mcuSize(m)
+	for mx := mx0; mx < mx1; mx++ {
+		e.startMCU()
+		x := bounds.Min.X + mx*size
+		switch m := m.(type) {
+		// TODO(wathiede): switch on m.ColorModel() instead of type.
+		case *image.Gray:
+			p := image.Pt(x, y)
+			grayToY(m, p, &b)
+			e.prevDC[0] = e.writeBlock(&b, 0, e.prevDC[0])
+		default:
+			rgba, _ := m.(*image.RGBA)
+			ycbcr, _ := m.(*image.YCbCr)
+			for i := 0; i < 4; i++ {
+				xOff := (i & 1) * 8
+				yOff := (i & 2) * 4
+				p := image.Pt(x+xOff, y+yOff)
+				if rgba != nil {
+					rgbaToYCbCr(rgba, p, &b, &cb[i], &cr[i])
+				} else if ycbcr != nil {
+					yCbCrToYCbCr(ycbcr, p, &b, &cb[i], &cr[i])
+				} else {
+					toYCbCr(m, p, &b, &cb[i], &cr[i])
 				}
-				scale(&b, &cb)
-				prevDCCb = e.writeBlock(&b, 1, prevDCCb)
-				scale(&b, &cr)
-				prevDCCr = e.writeBlock(&b, 1, prevDCCr)
+				e.prevDC[0] = e.writeBlock(&b, 0, e.prevDC[0])
 			}
+			scale(&b, &cb)
+			e.prevDC[1] = e.writeBlock(&b, 1, e.prevDC[1])
+			scale(&b, &cr)
+			e.prevDC[2] = e.writeBlock(&b, 1, e.prevDC[2])
 		}
 	}
-	// Pad the last byte with 1's.
+}
+
+// startMCU is called before writing each MCU. It writes a RST marker if the
+// MCU starts a restart interval, other than the first.
+func (e *encoder) startMCU() {
+	if e.ri > 0 && e.nMCU > 0 && e.nMCU%e.ri == 0 {
+		e.writeRST()
+	}
+	e.nMCU++
+}
+
+// writeRST ends a restart interval: it pads the last byte with 1's, writes
+// the next RST marker, and resets the delta-encoded DC components, as per
+// section F.1.2.3.
+func (e *encoder) writeRST() {
+	e.padBits()
+	e.buf[0] = 0xff
+	e.buf[1] = rst0Marker + uint8((e.nMCU/e.ri-1)%8)
+	e.write(e.buf[:2])
+	e.prevDC = [maxComponents]int32{}
+}
+
+// padBits pads the last byte with 1's, if it is incomplete, and writes it.
+func (e *encoder) padBits() {
 	e.emit(0x7f, 7)
+	e.bits, e.nBits = 0, 0
+}
+
+// finishSOS ends the entropy-coded data of the scan.
+func (e *encoder) finishSOS() {
+	// Pad the last byte with 1's.
+	e.padBits()
 }
 
 // DefaultQuality is the default quality encoding parameter.
@@ -568,6 +805,24 @@ const DefaultQuality = 75
 // Quality ranges from 1 to 100 inclusive, higher is better.
 type Options struct {
 	Quality int
+
+	// RestartInterval, if positive, is the number of MCUs (Minimum Coded
+	// Units, 16x16 pixels, or 8x8 for an *image.Gray) between RST restart
+	// markers. Restart markers let a decoder recover from corrupt data, and
+	// decode the restart intervals concurrently. It must be less than 65536.
+	RestartInterval int
+
+	// Workers, if greater than 1, is the number of goroutines that encode
+	// restart intervals concurrently. It has no effect unless
+	// RestartInterval is positive, or for a RowWriter. The output is the
+	// same as without Workers, but it is all held in memory until the last
+	// restart interval has been encoded.
+	Workers int
+
+	// Abbreviated means that an abbreviated image is written, without its
+	// quantization and Huffman tables. A decoder needs the tables-only
+	// stream that EncodeTables writes for the same Quality.
+	Abbreviated bool
 }
 
 // Encode writes the Image m to w in JPEG 4:2:0 baseline format with the given
@@ -578,20 +833,57 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 		return errors.New("jpeg: image is too large to encode")
 	}
 	var e encoder
+	if err := e.init(w, o); err != nil {
+		return err
+	}
+	// Compute number of components based on input image type.
+	nComponent := 3
+	switch m.(type) {
+	// TODO(wathiede): switch on m.ColorModel() instead of type.
+	case *image.Gray:
+		nComponent = 1
+	}
+	e.writeHeader(b.Size(), nComponent)
+	// Write the image data.
+	e.writeSOS(m)
+	e.writeEOI()
+	return e.err
+}
+
+// toWriter returns w if it is a writer, and a buffered writer for it
+// otherwise.
+func toWriter(w io.Writer) writer {
 	if ww, ok := w.(writer); ok {
-		e.w = ww
-	} else {
-		e.w = bufio.NewWriter(w)
+		return ww
+	}
+	return bufio.NewWriter(w)
+}
+
+// init sets the writer, the quantization tables and the other options of e.
+func (e *encoder) init(w io.Writer, o *Options) error {
+	if o != nil && (o.RestartInterval < 0 || o.RestartInterval >= 1<<16) {
+		return errors.New("jpeg: invalid RestartInterval option")
 	}
-	// Clip quality to [1, 100].
+	e.w = toWriter(w)
+	e.huff = theHuffmanLUT
 	quality := DefaultQuality
 	if o != nil {
+		e.ri, e.workers, e.abbreviated = o.RestartInterval, o.Workers, o.Abbreviated
 		quality = o.Quality
-		if quality < 1 {
-			quality = 1
-		} else if quality > 100 {
-			quality = 100
-		}
+	}
+	// Initialize the quantization tables.
+	q := quantTables(quality)
+	e.nQuant = copy(e.quant[:], q[:])
+	return nil
+}
+
+// quantTables returns the quantization tables, in zig-zag order, for the
+// given quality parameter, which is clipped to [1, 100].
+func quantTables(quality int) (q [nQuantIndex][blockSize]uint16) {
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
 	}
 	// Convert from a quality rating to a scaling factor.
 	var scale int
@@ -600,9 +892,8 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 	} else {
 		scale = 200 - quality*2
 	}
-	// Initialize the quantization tables.
-	for i := range e.quant {
-		for j := range e.quant[i] {
+	for i := range q {
+		for j := range q[i] {
 			x := int(unscaledQuant[i][j])
 			x = (x*scale + 50) / 100
 			if x < 1 {
@@ -610,32 +901,37 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 			} else if x > 255 {
 				x = 255
 			}
-			e.quant[i][j] = uint8(x)
+			q[i][j] = uint16(x)
 		}
 	}
-	// Compute number of components based on input image type.
-	nComponent := 3
-	switch m.(type) {
-	// TODO(wathiede): switch on m.ColorModel() instead of type.
-	case *image.Gray:
-		nComponent = 1
-	}
+	return q
+}
+
+// writeHeader writes the markers that precede the image data.
+func (e *encoder) writeHeader(size image.Point, nComponent int) {
 	// Write the Start Of Image marker.
 	e.buf[0] = 0xff
 	e.buf[1] = 0xd8
 	e.write(e.buf[:2])
 	// Write the quantization tables.
-	e.writeDQT()
+	if !e.abbreviated {
+		e.writeDQT()
+	}
 	// Write the image dimensions.
-	e.writeSOF0(b.Size(), nComponent)
+	e.writeSOF0(size, nComponent)
 	// Write the Huffman tables.
-	e.writeDHT(nComponent)
-	// Write the image data.
-	e.writeSOS(m)
-	// Write the End Of Image marker.
+	if !e.abbreviated {
+		e.writeDHT(nComponent)
+	}
+	if e.ri > 0 {
+		e.writeDRI()
+	}
+}
+
+// writeEOI writes the End Of Image marker and flushes the writer.
+func (e *encoder) writeEOI() {
 	e.buf[0] = 0xff
 	e.buf[1] = 0xd9
 	e.write(e.buf[:2])
 	e.flush()
-	return e.err
 }
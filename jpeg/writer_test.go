@@ -6,13 +6,18 @@ package jpeg
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"image/png"
 	"io"
 	"math/rand"
 	"os"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -287,3 +292,728 @@ func BenchmarkEncodeYCbCr(b *testing.B) {
 		Encode(io.Discard, img, options)
 	}
 }
+
+func TestRowWriter(t *testing.T) {
+	bo := image.Rect(3, 5, 153, 108)
+	rnd := rand.New(rand.NewSource(123))
+	gray := image.NewGray(bo)
+	rgba := image.NewRGBA(bo)
+	nrgba := image.NewNRGBA(bo)
+	ycbcr := image.NewYCbCr(bo, image.YCbCrSubsampleRatio420)
+	for y := bo.Min.Y; y < bo.Max.Y; y++ {
+		for x := bo.Min.X; x < bo.Max.X; x++ {
+			// Use a gradient with some noise, so that the image compresses.
+			v := uint8(x + 2*y + rnd.Intn(16))
+			gray.SetGray(x, y, color.Gray{v})
+			rgba.SetRGBA(x, y, color.RGBA{v, 255 - v, uint8(x), 255})
+			nrgba.SetNRGBA(x, y, color.NRGBA{v, uint8(y), 255 - v, 128})
+			ycbcr.Y[ycbcr.YOffset(x, y)] = v
+			ci := ycbcr.COffset(x, y)
+			ycbcr.Cb[ci], ycbcr.Cr[ci] = uint8(x), uint8(y)
+		}
+	}
+	for _, m := range []image.Image{gray, rgba, nrgba, ycbcr} {
+		var want bytes.Buffer
+		if err := Encode(&want, m, &Options{Quality: 90}); err != nil {
+			t.Fatal(err)
+		}
+		var got bytes.Buffer
+		rw, err := NewRowWriter(&got, image.Config{
+			ColorModel: m.ColorModel(),
+			Width:      bo.Dx(),
+			Height:     bo.Dy(),
+		}, &Options{Quality: 90})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Write strips of varying heights, that don't line up with MCUs.
+		type subImager interface {
+			SubImage(image.Rectangle) image.Image
+		}
+		for y, n := bo.Min.Y, 1; y < bo.Max.Y; y, n = y+n, n+6 {
+			strip := m.(subImager).SubImage(image.Rect(bo.Min.X, y, bo.Max.X, y+n))
+			if err := rw.WriteRows(strip); err != nil {
+				t.Fatalf("%T: WriteRows: %v", m, err)
+			}
+		}
+		if err := rw.Close(); err != nil {
+			t.Fatalf("%T: Close: %v", m, err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("%T: RowWriter and Encode output differ", m)
+		}
+	}
+
+	rw, err := NewRowWriter(io.Discard, image.Config{ColorModel: color.RGBAModel, Width: 16, Height: 16}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.WriteRows(image.NewRGBA(image.Rect(0, 0, 8, 8))); err == nil {
+		t.Error("WriteRows: got nil error for narrow rows")
+	}
+	if err := rw.WriteRows(image.NewRGBA(image.Rect(0, 0, 16, 8))); err != nil {
+		t.Errorf("WriteRows: %v", err)
+	}
+	if err := rw.WriteRows(image.NewRGBA(image.Rect(0, 0, 16, 9))); err == nil {
+		t.Error("WriteRows: got nil error for too many rows")
+	}
+	if err := rw.Close(); err == nil {
+		t.Error("Close: got nil error for missing rows")
+	}
+}
+
+func TestEncodeRestartInterval(t *testing.T) {
+	bo := image.Rect(0, 0, 150, 103)
+	rnd := rand.New(rand.NewSource(123))
+	gray := image.NewGray(bo)
+	rgba := image.NewRGBA(bo)
+	for y := bo.Min.Y; y < bo.Max.Y; y++ {
+		for x := bo.Min.X; x < bo.Max.X; x++ {
+			v := uint8(x + 2*y + rnd.Intn(16))
+			gray.SetGray(x, y, color.Gray{v})
+			rgba.SetRGBA(x, y, color.RGBA{v, 255 - v, uint8(x), 255})
+		}
+	}
+	for _, m := range []image.Image{gray, rgba} {
+		var plain bytes.Buffer
+		if err := Encode(&plain, m, nil); err != nil {
+			t.Fatal(err)
+		}
+		want, err := Decode(&plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ri := range []int{1, 3, 10, 1000} {
+			var serial bytes.Buffer
+			if err := Encode(&serial, m, &Options{Quality: DefaultQuality, RestartInterval: ri}); err != nil {
+				t.Fatal(err)
+			}
+			// Restart markers don't change the decoded image.
+			got, err := Decode(bytes.NewReader(serial.Bytes()))
+			if err != nil {
+				t.Fatalf("%T, %d: Decode: %v", m, ri, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%T, %d: decoded images differ", m, ri)
+			}
+			size := mcuSize(m)
+			nMCU := ((bo.Dx() + size - 1) / size) * ((bo.Dy() + size - 1) / size)
+			nRST := 0
+			for i := range serial.Len() - 1 {
+				if b := serial.Bytes(); b[i] == 0xff && b[i+1]&^7 == rst0Marker {
+					nRST++
+				}
+			}
+			if want := (nMCU - 1) / ri; nRST != want {
+				t.Errorf("%T, %d: got %d RST markers, want %d", m, ri, nRST, want)
+			}
+
+			for _, workers := range []int{2, 5} {
+				var parallel bytes.Buffer
+				if err := Encode(&parallel, m, &Options{Quality: DefaultQuality, RestartInterval: ri, Workers: workers}); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(parallel.Bytes(), serial.Bytes()) {
+					t.Errorf("%T, %d: output with %d workers differs", m, ri, workers)
+				}
+			}
+
+			var rows bytes.Buffer
+			rw, err := NewRowWriter(&rows, image.Config{
+				ColorModel: m.ColorModel(),
+				Width:      bo.Dx(),
+				Height:     bo.Dy(),
+			}, &Options{Quality: DefaultQuality, RestartInterval: ri})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := rw.WriteRows(m); err != nil {
+				t.Fatal(err)
+			}
+			if err := rw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rows.Bytes(), serial.Bytes()) {
+				t.Errorf("%T, %d: RowWriter output differs", m, ri)
+			}
+		}
+	}
+
+	if err := Encode(io.Discard, gray, &Options{RestartInterval: 1 << 16}); err == nil {
+		t.Error("got nil error for a RestartInterval of 65536")
+	}
+}
+
+func TestEncodeCoefficients(t *testing.T) {
+	for _, filename := range []string{
+		"../testdata/video-001",
+		"../testdata/video-001.q50.410",
+		"../testdata/video-001.q50.422.progressive",
+		"../testdata/video-001.arithmetic",
+		"../testdata/video-001.cmyk",
+		"../testdata/video-001.rgb",
+		"../testdata/video-001.restart2",
+		"../testdata/video-001.arithmetic",
+		"../testdata/video-005.gray.q50.2x2.progressive",
+	} {
+		data, want, err := readImage(filename + ".jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, zigZag := range []bool{false, true} {
+			c, err := DecodeCoefficients(context.Background(), bytes.NewReader(data), &CoefficientOptions{ZigZag: zigZag})
+			if err != nil {
+				t.Fatalf("%s: %v", filename, err)
+			}
+			var buf bytes.Buffer
+			if err := EncodeCoefficients(&buf, c); err != nil {
+				t.Fatalf("%s: EncodeCoefficients: %v", filename, err)
+			}
+			// The coefficients, and so the decoded image, are unchanged.
+			c2, err := DecodeCoefficients(context.Background(), bytes.NewReader(buf.Bytes()), &CoefficientOptions{ZigZag: zigZag})
+			if err != nil {
+				t.Fatalf("%s: DecodeCoefficients: %v", filename, err)
+			}
+			if !reflect.DeepEqual(c2.Components, c.Components) {
+				t.Errorf("%s: coefficients differ", filename)
+			}
+			if c2.AdobeTransform != c.AdobeTransform || c2.RestartInterval != c.RestartInterval {
+				t.Errorf("%s: got transform %d and restart interval %d, want %d and %d",
+					filename, c2.AdobeTransform, c2.RestartInterval, c.AdobeTransform, c.RestartInterval)
+			}
+			got, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("%s: Decode: %v", filename, err)
+			}
+			// Only the samples outside the bounds may differ, as the blocks
+			// that pad a non-interleaved scan are now coded.
+			if got.Bounds() != want.Bounds() {
+				t.Fatalf("%s: got bounds %v, want %v", filename, got.Bounds(), want.Bounds())
+			}
+			if err := checkImage(want.Bounds(), got, want); err != nil {
+				t.Errorf("%s: %v", filename, err)
+			}
+		}
+	}
+
+	data, err := os.ReadFile("../testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc   string
+		modify func(c *Coefficients)
+		want   string
+	}{
+		{"zero width", func(c *Coefficients) { c.Width = 0 }, ""},
+		{"too few blocks", func(c *Coefficients) { c.Width += 16 }, ""},
+		{"repeated identifier", func(c *Coefficients) { c.Components[1].ID = c.Components[0].ID }, ""},
+		{"zero quantization", func(c *Coefficients) { c.Components[0].Quant[5] = 0 }, ""},
+		{"large coefficient", func(c *Coefficients) { c.Components[2].Blocks[3][7] = 1024 }, "jpeg: AC coefficient out of range in block 3 of component 2"},
+		{"large arithmetic coefficient", func(c *Coefficients) {
+			c.Arithmetic = true
+			c.Components[2].Blocks[3][7] = 1024
+		}, "jpeg: AC coefficient out of range in block 3 of component 2"},
+		{"large DC delta", func(c *Coefficients) {
+			// Each MCU starts a restart interval, so the delta is the DC
+			// coefficient itself.
+			c.RestartInterval = 1
+			c.Components[2].Blocks[3][0] = -2048
+		}, "jpeg: DC coefficient delta out of range in block 3 of component 2"},
+		{"invalid sampling", func(c *Coefficients) { c.Components[0].H = 5 }, ""},
+	} {
+		c, err := DecodeCoefficients(context.Background(), bytes.NewReader(data), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.modify(c)
+		if err := EncodeCoefficients(io.Discard, c); err == nil {
+			t.Errorf("%s: got nil error", tc.desc)
+		} else if tc.want != "" && err.Error() != tc.want {
+			t.Errorf("%s: got error %q, want %q", tc.desc, err, tc.want)
+		}
+	}
+
+	// The largest coefficients that Huffman coding has codes for are
+	// encoded.
+	c, err := DecodeCoefficients(context.Background(), bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RestartInterval = 1
+	c.Components[2].Blocks[3][0] = 2047
+	c.Components[2].Blocks[3][7] = -1023
+	var buf bytes.Buffer
+	if err := EncodeCoefficients(&buf, c); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeCoefficients(context.Background(), &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := got.Components[2].Blocks[3]; b[0] != 2047 || b[7] != -1023 {
+		t.Errorf("got coefficients %d and %d, want 2047 and -1023", b[0], b[7])
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	for _, filename := range []string{
+		"../testdata/video-001",
+		"../testdata/video-001.q50.410",
+		"../testdata/video-001.q50.422.progressive",
+		"../testdata/video-001.separate.dc.progression.progressive",
+		"../testdata/video-001.cmyk",
+		"../testdata/video-001.restart2",
+		"../testdata/video-001.arithmetic",
+		"../testdata/video-005.gray.q50.2x2.progressive",
+	} {
+		data, m, err := readImage(filename + ".jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := DecodeCoefficients(context.Background(), bytes.NewReader(data), &CoefficientOptions{Metadata: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range []TranscodeOptions{{}, {Progressive: true}, {Arithmetic: true}, {Progressive: true, Arithmetic: true}} {
+			desc := fmt.Sprintf("%s, %+v", filename, o)
+			var buf bytes.Buffer
+			if err := Transcode(context.Background(), &buf, bytes.NewReader(data), &o); err != nil {
+				t.Fatalf("%s: %v", desc, err)
+			}
+			got, err := DecodeCoefficients(context.Background(), bytes.NewReader(buf.Bytes()), &CoefficientOptions{Metadata: true})
+			if err != nil {
+				t.Fatalf("%s: DecodeCoefficients: %v", desc, err)
+			}
+			if got.Progressive != o.Progressive || got.Arithmetic != o.Arithmetic {
+				t.Errorf("%s: got Progressive %t, Arithmetic %t", desc, got.Progressive, got.Arithmetic)
+			}
+			if !reflect.DeepEqual(got.Components, want.Components) || !reflect.DeepEqual(got.Metadata, want.Metadata) {
+				t.Errorf("%s: coefficients or metadata differ", desc)
+			}
+			if o.Progressive && len(got.Scans) < 2 {
+				t.Errorf("%s: got %d scans", desc, len(got.Scans))
+			}
+			var warnings []Warning
+			gotM, err := DecodeContext(context.Background(), bytes.NewReader(buf.Bytes()), &DecoderOptions{Warn: func(w Warning) {
+				warnings = append(warnings, w)
+			}})
+			if err != nil {
+				t.Fatalf("%s: Decode: %v", desc, err)
+			}
+			if len(warnings) > 0 {
+				t.Errorf("%s: got warnings %v", desc, warnings)
+			}
+			if err := checkImage(m.Bounds(), gotM, m); err != nil {
+				t.Errorf("%s: %v", desc, err)
+			}
+		}
+	}
+
+	// Invalid progressions are rejected.
+	data, err := os.ReadFile("../testdata/video-001.progressive.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc   string
+		modify func(scans []Scan) []Scan
+	}{
+		{"missing scan", func(scans []Scan) []Scan { return scans[:len(scans)-1] }},
+		{"AC before DC", func(scans []Scan) []Scan { return append(scans[1:2], scans...) }},
+		{"interleaved AC", func(scans []Scan) []Scan {
+			scans[0].SpectralEnd = 5
+			return scans
+		}},
+		{"sequential scan", func(scans []Scan) []Scan { return []Scan{{Components: []int{0, 1, 2}, SpectralEnd: 63}} }},
+	} {
+		c, err := DecodeCoefficients(context.Background(), bytes.NewReader(data), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Scans = tc.modify(c.Scans)
+		if err := EncodeCoefficients(io.Discard, c); err == nil {
+			t.Errorf("%s: got nil error", tc.desc)
+		}
+	}
+}
+
+func TestRequantize(t *testing.T) {
+	data, err := os.ReadFile("../testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m0, err := readPng("../testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testCase {
+		var buf bytes.Buffer
+		o := &TranscodeOptions{Requantize: &RequantizeOptions{Quality: tc.quality}}
+		if err := Transcode(context.Background(), &buf, bytes.NewReader(data), o); err != nil {
+			t.Fatalf("quality=%d: %v", tc.quality, err)
+		}
+		// The quantization tables are those that Encode uses.
+		c, err := DecodeCoefficients(context.Background(), bytes.NewReader(buf.Bytes()), &CoefficientOptions{ZigZag: true})
+		if err != nil {
+			t.Fatalf("quality=%d: DecodeCoefficients: %v", tc.quality, err)
+		}
+		q := quantTables(tc.quality)
+		for i, cc := range c.Components {
+			for j, x := range cc.Quant {
+				if x != int32(q[min(i, 1)][j]) {
+					t.Fatalf("quality=%d: component %d has wrong quantization table", tc.quality, i)
+				}
+			}
+		}
+		if tc.quality < 90 && buf.Len() >= len(data) {
+			t.Errorf("quality=%d: got %d bytes, want fewer than %d", tc.quality, buf.Len(), len(data))
+		}
+		m1, err := Decode(&buf)
+		if err != nil {
+			t.Fatalf("quality=%d: Decode: %v", tc.quality, err)
+		}
+		if got := averageDelta(m0, m1); got > tc.tolerance {
+			t.Errorf("quality=%d: average delta is too high: %d", tc.quality, got)
+		}
+	}
+
+	// Coefficients are rounded to the nearest value.
+	c := &Coefficients{
+		Width: 8, Height: 8,
+		Components: []ComponentCoefficients{{
+			ID: 1, H: 1, V: 1, BlocksWide: 1, BlocksHigh: 1,
+			Quant:  Block{0: 3, 1: 3, 2: 3, 3: 5},
+			Blocks: []Block{{0: 5, 1: -5, 2: 1, 3: 7}},
+		}},
+	}
+	for j := 4; j < blockSize; j++ {
+		c.Components[0].Quant[j] = 1
+	}
+	quant := Block{0: 2, 1: 2, 2: 4, 3: 5}
+	for j := 4; j < blockSize; j++ {
+		quant[j] = 1
+	}
+	if err := Requantize(c, &RequantizeOptions{Quant: []Block{quant}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Components[0].Blocks[0], (Block{0: 8, 1: -8, 2: 1, 3: 7}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if c.Components[0].Quant != quant {
+		t.Errorf("got quantization table %v, want %v", c.Components[0].Quant, quant)
+	}
+
+	// Invalid tables are rejected.
+	for _, quant := range [][]Block{{}, {quant, quant}, {{}}} {
+		if err := Requantize(c, &RequantizeOptions{Quant: quant}); err == nil {
+			t.Errorf("%d tables: got nil error", len(quant))
+		}
+	}
+
+	// Coefficients that a finer table takes out of the range of the DCT of
+	// 8-bit samples are clamped to it, and can be encoded.
+	c.Components[0].Quant = Block{0: 60, 1: 50, 2: 50}
+	c.Components[0].Blocks[0] = Block{0: -20, 1: 30, 2: -30}
+	for j := 3; j < blockSize; j++ {
+		c.Components[0].Quant[j] = 1
+	}
+	fine := Block{}
+	for j := range fine {
+		fine[j] = 1
+	}
+	if err := Requantize(c, &RequantizeOptions{Quant: []Block{fine}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Components[0].Blocks[0], (Block{0: -1024, 1: 1023, 2: -1023}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := EncodeCoefficients(io.Discard, c); err != nil {
+		t.Errorf("EncodeCoefficients: %v", err)
+	}
+}
+
+func TestEditMetadata(t *testing.T) {
+	// Keeping the metadata, which is at the start of these files, gives the
+	// same file.
+	for _, filename := range []string{
+		"../testdata/video-001",
+		"../testdata/video-001.progressive",
+		"../testdata/video-001.restart2",
+		"../testdata/video-001.arithmetic",
+		"../testdata/video-001.cmyk",
+	} {
+		data, err := os.ReadFile(filename + ".jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		keep := func(segments []Segment) ([]Segment, error) { return segments, nil }
+		if err := EditMetadata(context.Background(), &buf, bytes.NewReader(data), keep); err != nil {
+			t.Fatalf("%s: %v", filename, err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%s: file changed", filename)
+		}
+	}
+
+	data, err := os.ReadFile("../testdata/video-001.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	icc := make([]byte, 70000)
+	for i := range icc {
+		icc[i] = uint8(i)
+	}
+	iccSegments, err := NewICCSegments(icc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iccSegments) != 2 {
+		t.Fatalf("got %d ICC segments, want 2", len(iccSegments))
+	}
+	added := append([]Segment{
+		NewExifSegment([]byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00")),
+		NewXMPSegment([]byte("<x:xmpmeta/>")),
+		{Marker: comMarker, Data: []byte("hello")},
+	}, iccSegments...)
+	for _, tc := range []struct {
+		desc  string
+		edit  func([]Segment) []Segment
+		kinds []SegmentKind
+	}{
+		{"strip", func([]Segment) []Segment { return nil }, nil},
+		{"insert", func(segments []Segment) []Segment { return append(segments, added...) },
+			[]SegmentKind{JFIFSegment, ExifSegment, XMPSegment, CommentSegment, ICCSegment, ICCSegment}},
+		{"reorder", func(segments []Segment) []Segment { return append(added[2:3], segments...) },
+			[]SegmentKind{CommentSegment, JFIFSegment}},
+	} {
+		var buf bytes.Buffer
+		edit := func(segments []Segment) ([]Segment, error) { return tc.edit(segments), nil }
+		if err := EditMetadata(context.Background(), &buf, bytes.NewReader(data), edit); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		c, err := DecodeCoefficients(context.Background(), bytes.NewReader(buf.Bytes()), &CoefficientOptions{Metadata: true})
+		if err != nil {
+			t.Fatalf("%s: DecodeCoefficients: %v", tc.desc, err)
+		}
+		var kinds []SegmentKind
+		for _, m := range c.Metadata {
+			kinds = append(kinds, m.Kind())
+		}
+		if !reflect.DeepEqual(kinds, tc.kinds) {
+			t.Errorf("%s: got kinds %v, want %v", tc.desc, kinds, tc.kinds)
+		}
+		got, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: Decode: %v", tc.desc, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: decoded images differ", tc.desc)
+		}
+	}
+
+	// A comment after the frame header stays there when it is kept or
+	// replaced, and an inserted one is written straight after the SOI marker.
+	comment := func(s string) []byte {
+		return append([]byte{0xff, comMarker, 0x00, uint8(2 + len(s))}, s...)
+	}
+	sos := bytes.Index(data, []byte{0xff, sosMarker})
+	moved := slices.Concat(data[:sos], comment("old"), data[sos:])
+	// The JFIF segment is the 18 bytes after the SOI marker.
+	noJFIF := slices.Concat(moved[:2], moved[2+18:])
+	for _, tc := range []struct {
+		desc string
+		edit func([]Segment) []Segment
+		want []byte
+	}{
+		{"keep", func(segments []Segment) []Segment { return segments }, moved},
+		{"replace", func(segments []Segment) []Segment {
+			segments[1].Data = []byte("new")
+			return segments
+		}, bytes.Replace(moved, []byte("old"), []byte("new"), 1)},
+		{"insert", func(segments []Segment) []Segment {
+			return append(segments[1:], Segment{Marker: comMarker, Data: []byte("new")})
+		}, slices.Concat(noJFIF[:2], comment("new"), noJFIF[2:])},
+	} {
+		var buf bytes.Buffer
+		edit := func(segments []Segment) ([]Segment, error) { return tc.edit(segments), nil }
+		if err := EditMetadata(context.Background(), &buf, bytes.NewReader(moved), edit); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		if !bytes.Equal(buf.Bytes(), tc.want) {
+			t.Errorf("%s: got segments at the wrong places", tc.desc)
+		}
+	}
+
+	// Invalid segments are rejected, as are errors from edit.
+	for _, segments := range [][]Segment{
+		{{Marker: dqtMarker}},
+		{{Marker: comMarker, Data: make([]byte, 0x10000)}},
+	} {
+		edit := func([]Segment) ([]Segment, error) { return segments, nil }
+		if err := EditMetadata(context.Background(), io.Discard, bytes.NewReader(data), edit); err == nil {
+			t.Errorf("marker %#x: got nil error", segments[0].Marker)
+		}
+	}
+	errEdit := errors.New("edit failed")
+	edit := func([]Segment) ([]Segment, error) { return nil, errEdit }
+	if err := EditMetadata(context.Background(), io.Discard, bytes.NewReader(data), edit); err != errEdit {
+		t.Errorf("got %v, want %v", err, errEdit)
+	}
+	if _, err := NewICCSegments(make([]byte, 256*maxICCChunk)); err == nil {
+		t.Error("oversized ICC profile: got nil error")
+	}
+}
+
+func TestOptimalHuffmanSpec(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, tc := range []func(i int) int{
+		func(i int) int { return 0 },
+		func(i int) int { return 1 },
+		func(i int) int { return rnd.Intn(1000) },
+		// Fibonacci-like frequencies give codes that are too long.
+		func(i int) int { return 1 << (i / 8) },
+	} {
+		var counts [256]int
+		for i := range counts {
+			counts[i] = tc(i)
+		}
+		s := optimalHuffmanSpec(&counts)
+		n := 0
+		for _, c := range s.count {
+			n += int(c)
+		}
+		if n != len(s.value) {
+			t.Fatalf("%d codes for %d values", n, len(s.value))
+		}
+		// Every counted value has a code, and the codes are a prefix code
+		// with room for the all 1 bits code.
+		seen := map[byte]bool{}
+		for _, v := range s.value {
+			seen[v] = true
+		}
+		for v, c := range counts {
+			if c > 0 && !seen[byte(v)] {
+				t.Fatalf("value %d has no code", v)
+			}
+		}
+		kraft := 0
+		for i, c := range s.count {
+			kraft += int(c) << (15 - i)
+		}
+		if kraft >= 1<<16 {
+			t.Fatalf("codes are not a prefix code with room for the all 1 bits code")
+		}
+	}
+}
+
+func TestAbbreviated(t *testing.T) {
+	m0, err := readPng("../testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray := image.NewGray(m0.Bounds())
+	draw.Draw(gray, gray.Bounds(), m0, m0.Bounds().Min, draw.Src)
+	o := &Options{Quality: 60, Abbreviated: true}
+	var tablesBuf bytes.Buffer
+	if err := EncodeTables(&tablesBuf, o); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := DecodeTables(context.Background(), bytes.NewReader(tablesBuf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One Decoder decodes several abbreviated images with the tables.
+	dec := NewDecoder(&DecoderOptions{Tables: tables})
+	for _, m := range []image.Image{m0, gray} {
+		var full, abbreviated bytes.Buffer
+		if err := Encode(&full, m, &Options{Quality: o.Quality}); err != nil {
+			t.Fatal(err)
+		}
+		if err := Encode(&abbreviated, m, o); err != nil {
+			t.Fatal(err)
+		}
+		for s, err := range Segments(bytes.NewReader(abbreviated.Bytes())) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Marker == dqtMarker || s.Marker == dhtMarker {
+				t.Fatalf("%T: abbreviated image has a table segment", m)
+			}
+		}
+		if _, err := Decode(bytes.NewReader(abbreviated.Bytes())); err == nil {
+			t.Errorf("%T: decoding without the tables: got nil error", m)
+		}
+		want, err := Decode(&full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dec.Decode(context.Background(), &abbreviated)
+		if err != nil {
+			t.Fatalf("%T: %v", m, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: decoded images differ", m)
+		}
+	}
+
+	// An image from elsewhere, split into a tables-only stream and an
+	// abbreviated image, decodes as before. The tables between its scans
+	// stay in the image.
+	data, err := os.ReadFile("../testdata/video-001.progressive.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tablesOnly, abbreviated bytes.Buffer
+	scans := 0
+	for s, err := range Segments(bytes.NewReader(data)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := s.Offset + 2 + int64(s.Length) + int64(len(s.Scan))
+		switch {
+		case s.Marker == soiMarker || s.Marker == eoiMarker:
+			tablesOnly.Write(data[s.Offset:end])
+			abbreviated.Write(data[s.Offset:end])
+		case (s.Marker == dqtMarker || s.Marker == dhtMarker) && scans == 0:
+			tablesOnly.Write(data[s.Offset:end])
+		default:
+			abbreviated.Write(data[s.Offset:end])
+		}
+		if s.Marker == sosMarker {
+			scans++
+		}
+	}
+	tables, err = DecodeTables(context.Background(), &tablesOnly, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := DecodeCoefficients(context.Background(), bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeCoefficients(context.Background(), &abbreviated, &CoefficientOptions{Tables: tables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Components, want.Components) {
+		t.Error("coefficients differ")
+	}
+
+	// A tables-only stream has no image.
+	if _, err := DecodeTables(context.Background(), bytes.NewReader(data), nil); err == nil {
+		t.Error("decoding an image as tables: got nil error")
+	}
+
+	// Decoding tables can be canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DecodeTables(ctx, bytes.NewReader(tablesBuf.Bytes()), nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled: got %v, want %v", err, context.Canceled)
+	}
+}